@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/flush"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/health"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+// Helper function to create the handler for the admin listener.
+func adminMux(server *flush.Server, cfg aws.Config) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Profiles expose the command line and process internals, so they are opt-in.
+	if *cliPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	mux.Handle("/metrics", metrics.Handler())
+
+	mux.Handle("/healthz", health.Handler(func(ctx context.Context) error {
+		return server.Healthy(*cliLiveness)
+	}))
+
+	readiness := &health.Readiness{
+		Credentials: cfg.Credentials,
+		Client:      cloudwatchlogs.NewFromConfig(cfg),
+		Interval:    *cliReadyEvery,
+		MaxAge:      *cliReadyMaxAge,
+		Timeout:     *cliReadyTimeout,
+	}
+
+	go readiness.Run(context.Background())
+
+	mux.Handle("/readyz", health.Handler(readiness.Check))
+
+	return mux
+}
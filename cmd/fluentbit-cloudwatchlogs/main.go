@@ -2,47 +2,408 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/forward"
 	"github.com/skpr/fluentbit-cloudwatchlogs/internal/flush"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/kubernetes"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/routing"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/wal"
 )
 
+// How long to wait for Namespaces to be listed before routing lines without inherited annotations.
+const namespaceSyncTimeout = 30 * time.Second
+
 var (
-	cliAddr    = kingpin.Flag("addr", "Address to receive flush requests from Fluent Bit").Default(":8080").String()
-	cliPrefix  = kingpin.Flag("prefix", "Prefix to apply to CloudWatch Logs groups.").Envar("FLUENTBIT_CLOUDWATCHLOGS_PREFIX").Required().String()
-	cliCluster = kingpin.Flag("cluster", "Cluster which this process resides.").Envar("FLUENTBIT_CLOUDWATCHLOGS_CLUSTER").Required().String()
-	cliBatch   = kingpin.Flag("batch", "Amount of records which will be batched and sent.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BATCH").Default("256").Int()
-	cliDebug   = kingpin.Flag("debug", "Toggles on debugging.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEBUG").Bool()
+	cmdServe  = kingpin.Command("serve", "Receive flush requests from Fluent Bit and push them to CloudWatch Logs.").Default()
+	cmdReplay = kingpin.Command("replay", "Push lines from a dead-letter file or spool back to CloudWatch Logs.")
+	cmdRoutes = kingpin.Command("routes", "Inspect the routing rules.")
 )
 
-func main() {
-	kingpin.Parse()
+var (
+	cliAddr          = kingpin.Flag("addr", "Address to receive flush requests from Fluent Bit").Default(":8080").String()
+	cliFlushPath     = kingpin.Flag("flush-path", "Path to receive flush requests from Fluent Bit on.").Envar("FLUENTBIT_CLOUDWATCHLOGS_FLUSH_PATH").Default("/").String()
+	cliAdminAddr     = kingpin.Flag("admin-addr", "Address to serve metrics, health checks and pprof (when enabled) on. Set to an empty string to disable.").Envar("FLUENTBIT_CLOUDWATCHLOGS_ADMIN_ADDR").Default(":8081").String()
+	cliPprof         = kingpin.Flag("pprof", "Serve pprof on the admin listener. Anything which can reach the admin listener can profile the process.").Envar("FLUENTBIT_CLOUDWATCHLOGS_PPROF").Bool()
+	cliLiveness      = kingpin.Flag("liveness-threshold", "How long a flush or background loop can go without making progress before the process is not healthy.").Envar("FLUENTBIT_CLOUDWATCHLOGS_LIVENESS_THRESHOLD").Default("5m").Duration()
+	cliReadyEvery    = kingpin.Flag("readiness-interval", "How often CloudWatch Logs is called to check the process is ready.").Envar("FLUENTBIT_CLOUDWATCHLOGS_READINESS_INTERVAL").Default("30s").Duration()
+	cliReadyMaxAge   = kingpin.Flag("readiness-max-age", "How long ago CloudWatch Logs can have last been reached before the process is not ready.").Envar("FLUENTBIT_CLOUDWATCHLOGS_READINESS_MAX_AGE").Default("2m").Duration()
+	cliReadyTimeout  = kingpin.Flag("readiness-timeout", "Maximum time a readiness call to CloudWatch Logs can take.").Envar("FLUENTBIT_CLOUDWATCHLOGS_READINESS_TIMEOUT").Default("5s").Duration()
+	cliShutdownGrace = kingpin.Flag("shutdown-grace", "Time to finish flushes and drain pending lines after receiving SIGTERM. Must be less than terminationGracePeriodSeconds.").Envar("FLUENTBIT_CLOUDWATCHLOGS_SHUTDOWN_GRACE").Default("25s").Duration()
+	cliForward       = kingpin.Flag("forward-addr", "Address to receive messages from the Fluent Bit forward output eg. tcp://:24224 or unix:///var/run/fluentbit.sock").Envar("FLUENTBIT_CLOUDWATCHLOGS_FORWARD_ADDR").String()
+	cliForwardRead   = kingpin.Flag("forward-read-timeout", "Maximum time to wait for the next message on a forward connection before it is closed.").Envar("FLUENTBIT_CLOUDWATCHLOGS_FORWARD_READ_TIMEOUT").Default("60s").Duration()
+	cliPrefix        = kingpin.Flag("prefix", "Prefix to apply to CloudWatch Logs groups.").Envar("FLUENTBIT_CLOUDWATCHLOGS_PREFIX").Required().String()
+	cliGroupTmpl     = kingpin.Flag("group-template", "Go template for naming log groups. Has access to .Prefix, .Cluster, .Namespace, .Pod, .Container, .Labels, .Annotations and the lower, upper, trim, replace and sanitize functions.").Envar("FLUENTBIT_CLOUDWATCHLOGS_GROUP_TEMPLATE").Default(flush.DefaultGroupTemplate).String()
+	cliStreamTmpl    = kingpin.Flag("stream-template", "Go template for naming log streams. Has the same fields and functions as --group-template, plus .Node, .Time and .Date.").Envar("FLUENTBIT_CLOUDWATCHLOGS_STREAM_TEMPLATE").Default(flush.DefaultStreamTemplate).String()
+	cliFallbackTmpl  = kingpin.Flag("fallback-group-template", "Go template for naming log groups when --group-template fails eg. Pods without annotations. Lines are not routed when empty.").Envar("FLUENTBIT_CLOUDWATCHLOGS_FALLBACK_GROUP_TEMPLATE").String()
+	cliFallbackIncl  = kingpin.Flag("fallback-include-namespaces", "Comma separated namespaces which are shipped to the fallback group, all namespaces when empty. Supports wildcards eg. kube-*").Envar("FLUENTBIT_CLOUDWATCHLOGS_FALLBACK_INCLUDE_NAMESPACES").String()
+	cliFallbackExcl  = kingpin.Flag("fallback-exclude-namespaces", "Comma separated namespaces which are not shipped to the fallback group. Supports wildcards eg. kube-*").Envar("FLUENTBIT_CLOUDWATCHLOGS_FALLBACK_EXCLUDE_NAMESPACES").String()
+	cliNamespaceAnn  = kingpin.Flag("namespace-annotations", "Watch Namespaces so Pods inherit annotations which they don't set eg. fluentbit.skpr.io/project").Envar("FLUENTBIT_CLOUDWATCHLOGS_NAMESPACE_ANNOTATIONS").Bool()
+	cliRoutes        = kingpin.Flag("routes", "YAML or JSON file with ordered rules for routing lines, evaluated before the group and stream templates.").Envar("FLUENTBIT_CLOUDWATCHLOGS_ROUTES").String()
+	cliCluster       = kingpin.Flag("cluster", "Cluster which this process resides.").Envar("FLUENTBIT_CLOUDWATCHLOGS_CLUSTER").Required().String()
+	cliBatch         = kingpin.Flag("batch", "Amount of records which will be batched and sent.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BATCH").Default("256").Int()
+	cliOversize      = kingpin.Flag("oversize", "Policy for messages which exceed the CloudWatch Logs event size limit (truncate, split or deadletter).").Envar("FLUENTBIT_CLOUDWATCHLOGS_OVERSIZE").Default(string(dispatcher.OversizeTruncate)).Enum(dispatcher.OversizePolicies()...)
+	cliTime          = kingpin.Flag("time-policy", "Policy for events outside of the window CloudWatch Logs accepts (drop, clamp or deadletter).").Envar("FLUENTBIT_CLOUDWATCHLOGS_TIME_POLICY").Default(string(dispatcher.TimeDrop)).Enum(dispatcher.TimePolicies()...)
+	cliMaxAge        = kingpin.Flag("max-age", "Oldest event which will be pushed to CloudWatch Logs.").Envar("FLUENTBIT_CLOUDWATCHLOGS_MAX_AGE").Default(dispatcher.DefaultMaxAge.String()).Duration()
+	cliMaxFuture     = kingpin.Flag("max-future", "Furthest in the future an event which will be pushed to CloudWatch Logs can be.").Envar("FLUENTBIT_CLOUDWATCHLOGS_MAX_FUTURE").Default(dispatcher.DefaultMaxFuture.String()).Duration()
+	cliRetries       = kingpin.Flag("retry-attempts", "Attempts which will be made to push events when CloudWatch Logs returns a transient error.").Envar("FLUENTBIT_CLOUDWATCHLOGS_RETRY_ATTEMPTS").Default("5").Int()
+	cliRetryBase     = kingpin.Flag("retry-base-delay", "Delay before the first retry, doubled for each retry after that.").Envar("FLUENTBIT_CLOUDWATCHLOGS_RETRY_BASE_DELAY").Default("200ms").Duration()
+	cliRetryMax      = kingpin.Flag("retry-max-delay", "Maximum delay between retries.").Envar("FLUENTBIT_CLOUDWATCHLOGS_RETRY_MAX_DELAY").Default("5s").Duration()
+	cliFlushTimeout  = kingpin.Flag("flush-timeout", "Maximum time a flush can take before it is abandoned.").Envar("FLUENTBIT_CLOUDWATCHLOGS_FLUSH_TIMEOUT").Default("60s").Duration()
+	cliCacheTTL      = kingpin.Flag("cache-ttl", "How long log groups and streams are cached before they are created again. Set to 0 to disable.").Envar("FLUENTBIT_CLOUDWATCHLOGS_CACHE_TTL").Default("1h").Duration()
+	cliConcurrency   = kingpin.Flag("concurrency", "Amount of streams which will be pushed in parallel, shared by all flushes.").Envar("FLUENTBIT_CLOUDWATCHLOGS_CONCURRENCY").Default("4").Int()
+	cliAsync         = kingpin.Flag("async", "Buffer events in memory and push them in the background instead of during the flush. Cannot be combined with --wal-dir or --forward-addr.").Envar("FLUENTBIT_CLOUDWATCHLOGS_ASYNC").Bool()
+	cliBufferSize    = kingpin.Flag("buffer-size", "Maximum amount of events buffered across all streams in async mode.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BUFFER_SIZE").Default("100000").Int()
+	cliBufferStream  = kingpin.Flag("buffer-stream-size", "Maximum amount of events buffered for a single stream in async mode.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BUFFER_STREAM_SIZE").Default("20000").Int()
+	cliBufferFlush   = kingpin.Flag("buffer-flush-size", "Amount of events buffered for a stream which triggers a push in async mode.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BUFFER_FLUSH_SIZE").Default("1000").Int()
+	cliBufferAge     = kingpin.Flag("buffer-flush-interval", "Maximum time events are buffered before they are pushed in async mode.").Envar("FLUENTBIT_CLOUDWATCHLOGS_BUFFER_FLUSH_INTERVAL").Default("5s").Duration()
+	cliWALDir        = kingpin.Flag("wal-dir", "Directory for a write-ahead log which lines are appended to before they are acked.").Envar("FLUENTBIT_CLOUDWATCHLOGS_WAL_DIR").String()
+	cliWALSegment    = kingpin.Flag("wal-segment-size", "Size at which the write-ahead log starts a new segment.").Envar("FLUENTBIT_CLOUDWATCHLOGS_WAL_SEGMENT_SIZE").Default("16MB").Bytes()
+	cliWALMax        = kingpin.Flag("wal-max-size", "Maximum size of the write-ahead log before the oldest segments are evicted.").Envar("FLUENTBIT_CLOUDWATCHLOGS_WAL_MAX_SIZE").Default("1GB").Bytes()
+	cliWALBatch      = kingpin.Flag("wal-batch", "Amount of lines which are read from the write-ahead log and pushed at a time.").Envar("FLUENTBIT_CLOUDWATCHLOGS_WAL_BATCH").Default("5000").Int()
+	cliDeadLetter    = kingpin.Flag("dead-letter-file", "File which lines that could not be delivered are written to as newline delimited JSON.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEAD_LETTER_FILE").String()
+	cliDeadSize      = kingpin.Flag("dead-letter-max-size", "Size at which the dead-letter file is rotated.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEAD_LETTER_MAX_SIZE").Default("100MB").Bytes()
+	cliDeadFiles     = kingpin.Flag("dead-letter-max-files", "Amount of rotated dead-letter files which are kept.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEAD_LETTER_MAX_FILES").Default("5").Int()
+	cliDeadGroup     = kingpin.Flag("dead-letter-group", "CloudWatch Logs group which lines that could not be delivered are pushed to.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEAD_LETTER_GROUP").String()
+	cliDeadStream    = kingpin.Flag("dead-letter-stream", "CloudWatch Logs stream which lines that could not be delivered are pushed to. Defaults to the hostname.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEAD_LETTER_STREAM").String()
+	cliMaxBody       = kingpin.Flag("max-body-size", "Maximum size of a request body or forward message once it has been decompressed.").Envar("FLUENTBIT_CLOUDWATCHLOGS_MAX_BODY_SIZE").Default("64MB").Bytes()
+	cliFormat        = kingpin.Flag("format", "Format which Fluent Bit ships with (json, json_lines, json_stream or msgpack). Detected from the Content-Type header when not set, JSON arrays and sequences of JSON objects are told apart by the body.").Envar("FLUENTBIT_CLOUDWATCHLOGS_FORMAT").String()
+	cliDebug         = kingpin.Flag("debug", "Toggles on debugging.").Envar("FLUENTBIT_CLOUDWATCHLOGS_DEBUG").Bool()
+)
 
-	log.Println("Starting server")
+func main() {
+	switch kingpin.Parse() {
+	case cmdReplay.FullCommand():
+		runReplay()
+	case cmdRoutesTest.FullCommand():
+		runRoutesTest()
+	default:
+		runServe()
+	}
+}
 
+// Helper function to load the AWS configuration.
+func loadConfig() aws.Config {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		panic(err)
 	}
 
-	server := &flush.Server{
-		Client:    cloudwatchlogs.NewFromConfig(cfg),
-		Prefix:    *cliPrefix,
-		Cluster:   *cliCluster,
-		BatchSize: *cliBatch,
-		Debug:     *cliDebug,
+	return cfg
+}
+
+// Helper function to create a server which routes and pushes lines to CloudWatch Logs.
+func newServer(cfg aws.Config) *flush.Server {
+	groupTemplate, err := naming.Parse("group", *cliGroupTmpl)
+	if err != nil {
+		panic(err)
 	}
 
-	http.HandleFunc("/", server.ServeHTTP)
+	streamTemplate, err := naming.Parse("stream", *cliStreamTmpl)
+	if err != nil {
+		panic(err)
+	}
+
+	var routes *routing.Rules
+
+	if *cliRoutes != "" {
+		routes, err = routing.Load(*cliRoutes)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var fallback *flush.Fallback
+
+	if *cliFallbackTmpl != "" {
+		fallbackTemplate, err := naming.Parse("fallback", *cliFallbackTmpl)
+		if err != nil {
+			panic(err)
+		}
+
+		fallback = &flush.Fallback{
+			Template: fallbackTemplate,
+			Include:  split(*cliFallbackIncl),
+			Exclude:  split(*cliFallbackExcl),
+		}
+	}
+
+	var namespaces flush.Namespaces
+
+	if *cliNamespaceAnn {
+		cache, err := kubernetes.InClusterNamespaceCache(flush.AnnotationPrefix)
+		if err != nil {
+			panic(err)
+		}
+
+		go cache.Run(context.Background())
 
-	err = http.ListenAndServe(*cliAddr, nil)
+		// Lines are routed without inherited annotations until the Namespaces have been listed.
+		ctx, cancel := context.WithTimeout(context.Background(), namespaceSyncTimeout)
+		defer cancel()
+
+		err = cache.Wait(ctx)
+		if err != nil {
+			log.Println("Namespaces have not been listed yet:", err)
+		}
+
+		namespaces = cache
+	}
+
+	return &flush.Server{
+		Client:         cloudwatchlogs.NewFromConfig(cfg),
+		Prefix:         *cliPrefix,
+		Cluster:        *cliCluster,
+		GroupTemplate:  groupTemplate,
+		StreamTemplate: streamTemplate,
+		Routes:         routes,
+		Fallback:       fallback,
+		Namespaces:     namespaces,
+		BatchSize:      *cliBatch,
+		Format:         *cliFormat,
+		Oversize:       dispatcher.OversizePolicy(*cliOversize),
+		Time:           dispatcher.TimePolicy(*cliTime),
+		MaxAge:         *cliMaxAge,
+		MaxFuture:      *cliMaxFuture,
+		Retry: logger.Retry{
+			Attempts:  *cliRetries,
+			BaseDelay: *cliRetryBase,
+			MaxDelay:  *cliRetryMax,
+		},
+		FlushTimeout: *cliFlushTimeout,
+		CacheTTL:     *cliCacheTTL,
+		Concurrency:  *cliConcurrency,
+		Debug:        *cliDebug,
+	}
+}
+
+// Receive flush requests from Fluent Bit and push them to CloudWatch Logs.
+func runServe() {
+	log.Println("Starting server")
+
+	if *cliFormat != "" {
+		_, err := fluentbit.Lookup(*cliFormat)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *cliAsync && *cliWALDir != "" {
+		panic("async mode cannot be combined with a write-ahead log")
+	}
+
+	// Forward acks promise Fluent Bit that the lines won't be lost, which async mode's memory buffer can't keep.
+	if *cliAsync && *cliForward != "" {
+		panic("async mode cannot be combined with the forward listener")
+	}
+
+	var err error
+
+	cfg := loadConfig()
+
+	server := newServer(cfg)
+	server.Async = *cliAsync
+	server.BufferSize = *cliBufferSize
+	server.BufferStreamSize = *cliBufferStream
+	server.BufferFlushSize = *cliBufferFlush
+	server.BufferFlushInterval = *cliBufferAge
+	server.MaxBodySize = int64(*cliMaxBody)
+
+	if *cliWALDir != "" {
+		if *cliWALBatch < 1 {
+			panic("wal batch must be at least 1")
+		}
+
+		server.WAL, err = wal.Open(*cliWALDir, int64(*cliWALSegment), int64(*cliWALMax))
+		if err != nil {
+			panic(err)
+		}
+
+		server.WALBatchSize = *cliWALBatch
+	}
+
+	server.DeadLetter, err = deadLetter(server.Client)
 	if err != nil {
 		panic(err)
 	}
+
+	// Flushes are cancelled when the shutdown grace period ends, as http.Server.Shutdown doesn't cancel them.
+	flushes, cancelFlushes := context.WithCancel(context.Background())
+	defer cancelFlushes()
+
+	ingest := &http.Server{
+		Addr:    *cliAddr,
+		Handler: server.Handler(*cliFlushPath),
+		BaseContext: func(net.Listener) context.Context {
+			return flushes
+		},
+	}
+
+	go func() {
+		err := ingest.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	forwarder := &forward.Server{
+		Handler:        server.Flush,
+		MaxMessageSize: int64(*cliMaxBody),
+		ReadTimeout:    *cliForwardRead,
+		Debug:          *cliDebug,
+	}
+
+	if *cliForward != "" {
+		go func() {
+			log.Println("Starting forward listener")
+
+			err := forwarder.ListenAndServe(*cliForward)
+			if err != nil && !errors.Is(err, forward.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+	}
+
+	admin := &http.Server{
+		Addr: *cliAdminAddr,
+	}
+
+	// The readiness probe calls CloudWatch Logs in the background, so it only runs when it is served.
+	if *cliAdminAddr != "" {
+		admin.Handler = adminMux(server, cfg)
+
+		go func() {
+			log.Println("Starting admin listener")
+
+			err := admin.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	<-ctx.Done()
+
+	log.Printf("Shutting down within %s\n", *cliShutdownGrace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *cliShutdownGrace)
+	defer cancel()
+
+	// Flushes which are still in progress are cancelled so Fluent Bit retries them.
+	context.AfterFunc(ctx, cancelFlushes)
+
+	// Stop accepting requests on both listeners at the same time and wait for flushes which are in progress.
+	var (
+		wg                    sync.WaitGroup
+		ingestErr, forwardErr error
+	)
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		ingestErr = ingest.Shutdown(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		forwardErr = forwarder.Shutdown(ctx)
+	}()
+
+	wg.Wait()
+
+	err = errors.Join(ingestErr, forwardErr)
+	if err != nil {
+		log.Println("Abandoned flushes which were in progress:", err)
+	}
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Failed to drain pending lines:", err)
+	}
+
+	admin.Close()
+
+	log.Println("Shutdown complete")
+}
+
+// Helper function to create the sink for lines which could not be delivered.
+func deadLetter(client logger.API) (deadletter.Sink, error) {
+	var sinks deadletter.Multi
+
+	if *cliDeadLetter != "" {
+		file, err := deadletter.NewFile(*cliDeadLetter, int64(*cliDeadSize), *cliDeadFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, file)
+	}
+
+	if *cliDeadGroup != "" {
+		stream := *cliDeadStream
+
+		if stream == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+
+			stream = hostname
+		}
+
+		sinks = append(sinks, &deadletter.CloudWatch{
+			Client: client,
+			Cache:  logger.NewCache(*cliCacheTTL),
+			Group:  *cliDeadGroup,
+			Stream: stream,
+			Retry: logger.Retry{
+				Attempts:  *cliRetries,
+				BaseDelay: *cliRetryBase,
+				MaxDelay:  *cliRetryMax,
+			},
+		})
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	return sinks, nil
+}
+
+// Helper function to split a comma separated list, ignoring empty values.
+func split(list string) []string {
+	var values []string
+
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
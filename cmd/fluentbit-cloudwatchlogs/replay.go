@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/replay"
+)
+
+var (
+	cliReplayFile   = cmdReplay.Arg("file", "File containing newline delimited JSON or a Fluent Bit JSON array. Reads from stdin when not set.").String()
+	cliReplayDryRun = cmdReplay.Flag("dry-run", "Route lines and report where they would be pushed without pushing them.").Bool()
+	cliReplayRate   = cmdReplay.Flag("rate", "Maximum amount of lines pushed per second. Set to 0 to disable.").Default("1000").Float64()
+	cliReplayOffset = cmdReplay.Flag("offset", "Amount of lines to skip, used to resume an earlier replay.").Int()
+	cliReplayChunk  = cmdReplay.Flag("chunk", "Amount of lines which are routed and pushed at a time.").Default("1000").Int()
+)
+
+// Push lines from a dead-letter file or spool back to CloudWatch Logs.
+func runReplay() {
+	var reader io.Reader = os.Stdin
+
+	if *cliReplayFile != "" {
+		f, err := os.Open(*cliReplayFile)
+		if err != nil {
+			panic(err)
+		}
+
+		defer f.Close()
+
+		reader = f
+	}
+
+	server := newServer(loadConfig())
+
+	// Lines which still cannot be delivered are dead-lettered again, unless this is a dry run.
+	if !*cliReplayDryRun {
+		if *cliReplayFile != "" && *cliDeadLetter != "" && sameFile(*cliReplayFile, *cliDeadLetter) {
+			panic("cannot replay the dead-letter file which is being written to, replay a rotated file or a copy instead")
+		}
+
+		var err error
+
+		server.DeadLetter, err = deadLetter(server.Client)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	replayer := &replay.Replayer{
+		Server:    server,
+		BatchSize: *cliReplayChunk,
+		Rate:      *cliReplayRate,
+		Offset:    *cliReplayOffset,
+		DryRun:    *cliReplayDryRun,
+		Output:    os.Stdout,
+	}
+
+	offset, err := replayer.Replay(context.Background(), reader)
+	if err != nil {
+		log.Fatalf("Failed to replay lines, resume with --offset=%d: %s\n", offset, err)
+	}
+
+	var skipped int
+
+	for _, count := range replayer.Skipped() {
+		skipped += count
+	}
+
+	log.Printf("Finished replaying %d lines, %d of which were skipped\n", offset, skipped)
+}
+
+// Helper function to check if two paths are the same file.
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/flush"
+)
+
+var (
+	cmdRoutesTest       = cmdRoutes.Command("test", "Print which rules match sample records and where they would be pushed.")
+	cliRoutesTestRecord = cmdRoutesTest.Arg("file", "File containing one or more Fluent Bit JSON records. Reads from stdin when not set.").String()
+)
+
+// Print which routing rules match sample records and the destinations they would be pushed to.
+func runRoutesTest() {
+	var reader io.Reader = os.Stdin
+
+	if *cliRoutesTestRecord != "" {
+		f, err := os.Open(*cliRoutesTestRecord)
+		if err != nil {
+			panic(err)
+		}
+
+		defer f.Close()
+
+		reader = f
+	}
+
+	// Records are only routed so CloudWatch Logs is never called.
+	server := newServer(aws.Config{})
+
+	decoder := json.NewStreamDecoder(reader)
+
+	for i := 1; ; i++ {
+		line, err := decoder.Next()
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Record %d\n", i)
+
+		result, destinations, err := server.Destinations(line)
+		if errors.Is(err, flush.ErrSkipped) {
+			fmt.Printf("  Skipped:     %s\n", err)
+			continue
+		}
+
+		if len(result.Rules) > 0 {
+			fmt.Printf("  Rules:       %s\n", strings.Join(result.Rules, ", "))
+		} else {
+			fmt.Println("  Rules:       none matched, using the default destination")
+		}
+
+		switch {
+		case err != nil:
+			fmt.Printf("  Unrouted:    %s\n", err)
+		case result.Drop && len(destinations) == 0:
+			fmt.Println("  Dropped")
+		case len(destinations) == 0:
+			fmt.Println("  Excluded:    namespace is excluded from the fallback group")
+		default:
+			for _, destination := range destinations {
+				fmt.Printf("  Destination: %s %s\n", destination.Group, destination.Stream)
+			}
+		}
+	}
+}
@@ -2,84 +2,344 @@ package dispatcher
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 
 	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
 )
 
 // Client for orchestrating dispatching to CloudWatch Logs.
 type Client struct {
 	// Client for interacting with CloudWatch Logs.
-	client *cloudwatchlogs.Client
-	// Amount of events to keep before pushing.
-	batchSize int
+	client logger.API
+	// Configuration for how events are dispatched.
+	config Config
 	// Content which will be pushed to CloudWatch Logs.
 	Groups map[string]Streams
+}
+
+// Config for dispatching logs to CloudWatch Logs.
+type Config struct {
+	// Amount of events to keep before pushing.
+	BatchSize int
+	// Policy for messages which exceed the CloudWatch Logs event size limit.
+	Oversize OversizePolicy
+	// Policy for events which are outside of the window CloudWatch Logs accepts.
+	Time TimePolicy
+	// Oldest event which will be pushed. Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+	// Furthest in the future an event which will be pushed can be. Defaults to DefaultMaxFuture.
+	MaxFuture time.Duration
+	// Rejected is called with events which will not be pushed to CloudWatch Logs.
+	Rejected RejectedFunc
+	// Retry configuration for pushing events.
+	Retry logger.Retry
+	// Cache of log groups and streams which are known to exist.
+	Cache *logger.Cache
+	// Locks shared between dispatchers so only one push to a stream happens at a time.
+	Locks *StreamLocks
+	// Limiter shared between dispatchers which bounds the amount of streams pushed in parallel by all of them.
+	Limiter *Limiter
+	// Amount of streams which will be pushed in parallel by this dispatcher.
+	Concurrency int
 	// Turns on debugging output.
-	debug bool
+	Debug bool
 }
 
+// RejectedFunc is called with a line which will not be pushed to CloudWatch Logs and the reason why.
+// It may be called from multiple goroutines at the same time.
+type RejectedFunc func(group, stream string, line Line, reason string)
+
 // Streams which will be updated.
 type Streams map[string]Lines
 
+// Line which will be pushed to CloudWatch Logs.
+type Line struct {
+	// Event which will be pushed.
+	Event types.InputLogEvent
+	// Kubernetes metadata of the line, kept so lines which cannot be pushed can be dead-lettered.
+	Source fluentbit.Kubernetes
+}
+
 // Lines which will be pushed to CloudWatch Logs.
-type Lines []types.InputLogEvent
+type Lines []Line
+
+// Sort lines chronologically, which is required by PutLogEvents.
+// Lines with the same timestamp keep the order they were added in.
+func (l Lines) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		return aws.ToInt64(l[i].Event.Timestamp) < aws.ToInt64(l[j].Event.Timestamp)
+	})
+}
 
 // New client for dispatching logs to CloudWatch Logs.
-func New(client *cloudwatchlogs.Client, batchSize int, debug bool) (*Client, error) {
+func New(client logger.API, config Config) (*Client, error) {
+	if config.Oversize == "" {
+		config.Oversize = OversizeTruncate
+	}
+
+	if config.Time == "" {
+		config.Time = TimeDrop
+	}
+
+	if config.MaxAge == 0 {
+		config.MaxAge = DefaultMaxAge
+	}
+
+	if config.MaxFuture == 0 {
+		config.MaxFuture = DefaultMaxFuture
+	}
+
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
 	return &Client{
-		client:    client,
-		Groups:    make(map[string]Streams),
-		batchSize: batchSize,
-		debug:     debug,
+		client: client,
+		config: config,
+		Groups: make(map[string]Streams),
 	}, nil
 }
 
-// Add log messages into a list which is grouped by LogGroup and Stream.
-func (c *Client) Add(group, stream string, timestamp time.Time, message string) error {
+// Add a line into a list which is grouped by LogGroup and Stream.
+func (c *Client) Add(group, stream string, line fluentbit.Line) error {
 	if _, ok := c.Groups[group]; !ok {
 		c.Groups[group] = make(Streams)
 	}
 
-	c.Groups[group][stream] = append(c.Groups[group][stream], types.InputLogEvent{
+	message := line.Log
+
+	timestamp, ok := c.window(group, stream, line)
+	if !ok {
+		return nil
+	}
+
+	messages := []string{message}
+
+	if len(message) > MaxMessageBytes {
+		switch c.config.Oversize {
+		case OversizeTruncate:
+			messages = []string{truncate(message)}
+		case OversizeSplit:
+			messages = split(message)
+		case OversizeDeadLetter:
+			c.reject(group, stream, Line{Event: event(timestamp, message), Source: line.Kubernetes}, ReasonOversize)
+			messages = nil
+		default:
+			return fmt.Errorf("unknown oversize policy: %s", c.config.Oversize)
+		}
+
+		oversizeEvents.Inc(string(c.config.Oversize))
+	}
+
+	for _, m := range messages {
+		c.Groups[group][stream] = append(c.Groups[group][stream], Line{
+			Event:  event(timestamp, m),
+			Source: line.Kubernetes,
+		})
+	}
+
+	return nil
+}
+
+// Helper function to apply the time policy to events outside of the window CloudWatch Logs accepts.
+// Returns the timestamp to use and false if the event should not be pushed.
+func (c *Client) window(group, stream string, line fluentbit.Line) (time.Time, bool) {
+	now := time.Now()
+	timestamp := line.Timestamp
+
+	var reason string
+
+	switch {
+	case timestamp.Before(now.Add(-c.config.MaxAge)):
+		reason = logger.ReasonTooOld
+	case timestamp.After(now.Add(c.config.MaxFuture)):
+		reason = logger.ReasonTooNew
+	default:
+		return timestamp, true
+	}
+
+	timestampEvents.Inc(string(c.config.Time))
+
+	switch c.config.Time {
+	case TimeClamp:
+		return now, true
+	case TimeDeadLetter:
+		c.reject(group, stream, Line{Event: event(timestamp, line.Log), Source: line.Kubernetes}, reason)
+	default:
+		if c.config.Debug {
+			log.Printf("dropping event for %s/%s because: %s\n", group, stream, reason)
+		}
+	}
+
+	return timestamp, false
+}
+
+// Helper function to pass a line to the rejected handler.
+func (c *Client) reject(group, stream string, line Line, reason string) {
+	if c.config.Rejected == nil {
+		return
+	}
+
+	c.config.Rejected(group, stream, line, reason)
+}
+
+// Helper function to create an event.
+func event(timestamp time.Time, message string) types.InputLogEvent {
+	return types.InputLogEvent{
 		Message:   aws.String(message),
 		Timestamp: aws.Int64(timestamp.UnixNano() / int64(time.Millisecond)),
-	})
+	}
+}
 
-	return nil
+// StreamError is returned when events could not be pushed to a stream.
+type StreamError struct {
+	Group  string
+	Stream string
+	Err    error
+}
+
+// Error returns the stream and the reason it failed.
+func (e StreamError) Error() string {
+	return fmt.Sprintf("%s/%s: %s", e.Group, e.Stream, e.Err)
+}
+
+// SendError is returned when one or more streams could not be sent.
+type SendError struct {
+	// Failed streams. Streams which are not listed were sent successfully.
+	Failed []StreamError
+}
+
+// Error returns a list of the streams which failed.
+func (e *SendError) Error() string {
+	var failed []string
+
+	for _, f := range e.Failed {
+		failed = append(failed, f.Error())
+	}
+
+	return fmt.Sprintf("failed to send %d stream(s): %s", len(e.Failed), strings.Join(failed, "; "))
+}
+
+// Unwrap returns the errors for each stream.
+func (e *SendError) Unwrap() []error {
+	var errs []error
+
+	for _, f := range e.Failed {
+		errs = append(errs, f.Err)
+	}
+
+	return errs
 }
 
 // Send logs to CloudWatch Logs.
+//
+// Streams are pushed in parallel by a pool of workers, which is also bounded by the
+// shared Limiter. A failure to send one stream does not prevent the remaining streams
+// from being sent. Streams which failed are returned as a SendError.
 func (c *Client) Send(ctx context.Context) error {
-	for group, streams := range c.Groups {
-		for stream, lines := range streams {
-			if c.debug {
-				log.Printf("Pushing %d logs for %s/%s\n", len(lines), group, stream)
-			}
+	type job struct {
+		group  string
+		stream string
+		lines  Lines
+	}
 
-			l, err := logger.New(ctx, c.client, group, stream, c.batchSize)
-			if err != nil {
-				return err
-			}
+	var (
+		jobs   = make(chan job)
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		failed []StreamError
+	)
 
-			for _, line := range lines {
-				err = l.Add(ctx, line)
+	for i := 0; i < c.config.Concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				err := c.send(ctx, j.group, j.stream, j.lines)
 				if err != nil {
-					return err
+					lock.Lock()
+					failed = append(failed, StreamError{
+						Group:  j.group,
+						Stream: j.stream,
+						Err:    err,
+					})
+					lock.Unlock()
 				}
 			}
+		}()
+	}
 
-			err = l.Flush(ctx)
-			if err != nil {
-				return err
-			}
+	for group, streams := range c.Groups {
+		for stream, lines := range streams {
+			jobs <- job{group: group, stream: stream, lines: lines}
 		}
 	}
 
+	close(jobs)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &SendError{Failed: failed}
+	}
+
 	return nil
 }
+
+// Helper function to send lines to a single stream.
+func (c *Client) send(ctx context.Context, group, stream string, lines Lines) error {
+	// Events must be pushed to a stream in order, so we wait for any other
+	// dispatchers which are pushing to the same stream.
+	unlock := c.config.Locks.Lock(group, stream)
+	defer unlock()
+
+	// Waiting on a stream which is busy doesn't hold up a slot which another stream could use.
+	release, err := c.config.Limiter.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	lines.Sort()
+
+	if c.config.Debug {
+		log.Printf("Pushing %d logs for %s/%s\n", len(lines), group, stream)
+	}
+
+	l, err := logger.New(ctx, c.client, c.config.Cache, group, stream, c.config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	// Events which CloudWatch Logs rejects are matched back to their line by the
+	// message pointer, which is unique to each event.
+	sources := make(map[*string]fluentbit.Kubernetes, len(lines))
+
+	for _, line := range lines {
+		sources[line.Event.Message] = line.Source
+	}
+
+	l.Retry = c.config.Retry
+	l.Rejected = func(event types.InputLogEvent, reason string) {
+		c.reject(group, stream, Line{Event: event, Source: sources[event.Message]}, reason)
+	}
+
+	for _, line := range lines {
+		err = l.Add(ctx, line.Event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.Flush(ctx)
+}
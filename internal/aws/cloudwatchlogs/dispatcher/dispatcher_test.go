@@ -0,0 +1,131 @@
+package dispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Helper function to return the messages from a list of events.
+func messages(events []types.InputLogEvent) []string {
+	var m []string
+
+	for _, event := range events {
+		m = append(m, aws.ToString(event.Message))
+	}
+
+	return m
+}
+
+// Helper function to return the messages from a list of lines.
+func lineMessages(lines Lines) []string {
+	var m []string
+
+	for _, line := range lines {
+		m = append(m, aws.ToString(line.Event.Message))
+	}
+
+	return m
+}
+
+// Helper function to create a line.
+func line(timestamp time.Time, message string) fluentbit.Line {
+	return fluentbit.Line{
+		Timestamp: timestamp,
+		Log:       message,
+	}
+}
+
+func TestSort(t *testing.T) {
+	now := time.Now()
+
+	lines := Lines{
+		{Event: event(now.Add(2*time.Second), "c")},
+		{Event: event(now, "a1")},
+		{Event: event(now.Add(time.Second), "b")},
+		{Event: event(now, "a2")},
+		{Event: event(now, "a3")},
+	}
+
+	lines.Sort()
+
+	assert.Equal(t, []string{"a1", "a2", "a3", "b", "c"}, lineMessages(lines))
+}
+
+func TestSendInterleaved(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(api, Config{BatchSize: 2})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	// Two inputs which have been merged out of order.
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(1*time.Second), "input1-1")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(3*time.Second), "input1-2")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(0*time.Second), "input2-1")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(2*time.Second), "input2-2")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(4*time.Second), "input2-3")))
+
+	assert.Nil(t, client.Send(context.TODO()))
+
+	// Ordering is preserved across batch splits.
+	assert.Len(t, api.Batches, 3)
+	assert.Equal(t, []string{"input2-1", "input1-1"}, messages(api.Batches[0]))
+	assert.Equal(t, []string{"input2-2", "input1-2"}, messages(api.Batches[1]))
+	assert.Equal(t, []string{"input2-3"}, messages(api.Batches[2]))
+}
+
+func TestSendPartialFailure(t *testing.T) {
+	api := &loggertest.API{
+		Errors: map[string]error{
+			"broken": &types.InvalidParameterException{},
+		},
+	}
+
+	client, err := New(api, Config{BatchSize: 10})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.Nil(t, client.Add("group", "broken", line(now, "foo")))
+	assert.Nil(t, client.Add("group", "working", line(now, "bar")))
+
+	err = client.Send(context.TODO())
+
+	var sendErr *SendError
+	assert.ErrorAs(t, err, &sendErr)
+	assert.Len(t, sendErr.Failed, 1)
+	assert.Equal(t, "broken", sendErr.Failed[0].Stream)
+
+	// The stream which did not fail was still sent.
+	assert.Len(t, api.Batches, 1)
+	assert.Equal(t, []string{"bar"}, messages(api.Batches[0]))
+}
+
+func TestSendConcurrency(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(api, Config{
+		BatchSize:   10,
+		Locks:       NewStreamLocks(),
+		Concurrency: 4,
+	})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	for _, stream := range []string{"a", "b", "c", "d", "e", "f"} {
+		assert.Nil(t, client.Add("group", stream, line(now, stream)))
+	}
+
+	assert.Nil(t, client.Send(context.TODO()))
+	assert.Len(t, api.Batches, 6)
+}
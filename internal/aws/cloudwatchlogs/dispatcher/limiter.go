@@ -0,0 +1,40 @@
+package dispatcher
+
+import (
+	"context"
+)
+
+// Limiter bounds the amount of streams which are pushed in parallel across all dispatchers
+// which share it, so concurrent flushes can't multiply the amount of pushes.
+//
+// A nil Limiter is valid and does not limit.
+type Limiter struct {
+	// Slots which are held while a stream is being pushed.
+	slots chan struct{}
+}
+
+// NewLimiter returns a limiter which allows n pushes at a time.
+func NewLimiter(n int) *Limiter {
+	if n < 1 {
+		n = 1
+	}
+
+	return &Limiter{
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Acquire a slot, returning a function which releases it. Returns an error if the context
+// is done before a slot is available.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
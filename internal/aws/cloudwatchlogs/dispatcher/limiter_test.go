@@ -0,0 +1,68 @@
+package dispatcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(2)
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		active  int
+		highest int
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			release, err := limiter.Acquire(context.TODO())
+			assert.Nil(t, err)
+			defer release()
+
+			lock.Lock()
+			active++
+			highest = max(highest, active)
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			active--
+			lock.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, 2, highest)
+
+	// Waiting for a slot is abandoned once the context is done.
+	release, err := limiter.Acquire(context.TODO())
+	assert.Nil(t, err)
+	defer release()
+
+	_, err = limiter.Acquire(context.TODO())
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err = limiter.Acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// A nil Limiter does not limit.
+	var disabled *Limiter
+	release, err = disabled.Acquire(context.TODO())
+	assert.Nil(t, err)
+	release()
+}
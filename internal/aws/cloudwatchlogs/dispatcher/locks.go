@@ -0,0 +1,66 @@
+package dispatcher
+
+import (
+	"sync"
+)
+
+// StreamLocks ensures only one push to a stream happens at a time, while allowing
+// different streams to be pushed in parallel.
+//
+// A nil StreamLocks is valid and does not lock.
+type StreamLocks struct {
+	// Lock to protect the streams map.
+	lock sync.Mutex
+	// Locks which are currently held or waited on, keyed by group and stream.
+	streams map[string]*streamLock
+}
+
+// Lock for a single stream which is removed once it is no longer referenced.
+type streamLock struct {
+	sync.Mutex
+	// Amount of callers holding or waiting on the lock.
+	refs int
+}
+
+// NewStreamLocks returns locks which can be shared between dispatchers.
+func NewStreamLocks() *StreamLocks {
+	return &StreamLocks{
+		streams: make(map[string]*streamLock),
+	}
+}
+
+// Lock a stream, returning a function which unlocks it.
+func (l *StreamLocks) Lock(group, stream string) func() {
+	if l == nil {
+		return func() {}
+	}
+
+	key := group + ":" + stream
+
+	l.lock.Lock()
+
+	s, ok := l.streams[key]
+	if !ok {
+		s = &streamLock{}
+		l.streams[key] = s
+	}
+
+	s.refs++
+
+	l.lock.Unlock()
+
+	s.Lock()
+
+	return func() {
+		s.Unlock()
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		s.refs--
+
+		if s.refs == 0 {
+			delete(l.streams, key)
+		}
+	}
+}
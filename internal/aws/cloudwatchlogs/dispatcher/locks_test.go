@@ -0,0 +1,49 @@
+package dispatcher
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamLocks(t *testing.T) {
+	locks := NewStreamLocks()
+
+	var (
+		wg      sync.WaitGroup
+		holding = make(map[string]int)
+		lock    sync.Mutex
+	)
+
+	for i := 0; i < 50; i++ {
+		for _, stream := range []string{"a", "b"} {
+			wg.Add(1)
+
+			go func(stream string) {
+				defer wg.Done()
+
+				unlock := locks.Lock("group", stream)
+				defer unlock()
+
+				lock.Lock()
+				holding[stream]++
+				assert.Equal(t, 1, holding[stream])
+				lock.Unlock()
+
+				lock.Lock()
+				holding[stream]--
+				lock.Unlock()
+			}(stream)
+		}
+	}
+
+	wg.Wait()
+
+	// Locks are removed once they are no longer referenced.
+	assert.Empty(t, locks.streams)
+
+	// A nil StreamLocks does not lock.
+	var disabled *StreamLocks
+	disabled.Lock("group", "stream")()
+}
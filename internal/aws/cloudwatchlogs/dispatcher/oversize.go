@@ -0,0 +1,85 @@
+package dispatcher
+
+import (
+	"fmt"
+	"hash/fnv"
+	"unicode/utf8"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+// OversizePolicy for messages which exceed the CloudWatch Logs event size limit.
+type OversizePolicy string
+
+const (
+	// OversizeTruncate cuts the message down to the limit and appends TruncatedMarker.
+	OversizeTruncate OversizePolicy = "truncate"
+	// OversizeSplit breaks the message into sequenced chunks which share a correlation id.
+	OversizeSplit OversizePolicy = "split"
+	// OversizeDeadLetter diverts the message to the dead-letter handler.
+	OversizeDeadLetter OversizePolicy = "deadletter"
+)
+
+const (
+	// MaxMessageBytes is the largest message which can be pushed in a single event.
+	MaxMessageBytes = logger.MaxEventBytes - logger.EventOverhead
+	// TruncatedMarker is appended to messages which have been truncated.
+	TruncatedMarker = "...[truncated]"
+	// Bytes reserved for the "[id i/n] " prefix of split messages.
+	splitPrefixBytes = 64
+)
+
+// ReasonOversize is the reason given when an oversized message is dead-lettered.
+const ReasonOversize = "oversize"
+
+// Counts for each outcome of the oversize policy.
+var oversizeEvents = metrics.NewCounter("oversize_events_total", "Messages which exceeded the CloudWatch Logs event size limit, by policy.", "policy")
+
+// OversizePolicies which can be configured.
+func OversizePolicies() []string {
+	return []string{string(OversizeTruncate), string(OversizeSplit), string(OversizeDeadLetter)}
+}
+
+// Helper function to truncate a message to the event size limit.
+func truncate(message string) string {
+	return validUTF8Prefix(message, MaxMessageBytes-len(TruncatedMarker)) + TruncatedMarker
+}
+
+// Helper function to split a message into chunks which fit the event size limit.
+//
+// Each chunk is prefixed with "[id i/n] " so the chunks can be correlated and reassembled.
+func split(message string) []string {
+	h := fnv.New64a()
+	h.Write([]byte(message))
+	id := fmt.Sprintf("%016x", h.Sum64())
+
+	var chunks []string
+
+	for len(message) > 0 {
+		chunk := validUTF8Prefix(message, MaxMessageBytes-splitPrefixBytes)
+		chunks = append(chunks, chunk)
+		message = message[len(chunk):]
+	}
+
+	for i, chunk := range chunks {
+		chunks[i] = fmt.Sprintf("[%s %d/%d] %s", id, i+1, len(chunks), chunk)
+	}
+
+	return chunks
+}
+
+// Helper function to return the longest prefix of a string which is at most n bytes and does not split a rune.
+func validUTF8Prefix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(s[i]) {
+			return s[:i]
+		}
+	}
+
+	return s[:n]
+}
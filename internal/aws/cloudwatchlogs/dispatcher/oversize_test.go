@@ -0,0 +1,76 @@
+package dispatcher
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+)
+
+func TestOversizeTruncate(t *testing.T) {
+	client, err := New(&loggertest.API{}, Config{Oversize: OversizeTruncate})
+	assert.Nil(t, err)
+
+	assert.Nil(t, client.Add("group", "stream", line(time.Now(), strings.Repeat("a", MaxMessageBytes+1))))
+
+	lines := client.Groups["group"]["stream"]
+	assert.Len(t, lines, 1)
+	assert.Len(t, *lines[0].Event.Message, MaxMessageBytes)
+	assert.True(t, strings.HasSuffix(*lines[0].Event.Message, TruncatedMarker))
+}
+
+func TestOversizeSplit(t *testing.T) {
+	client, err := New(&loggertest.API{}, Config{Oversize: OversizeSplit})
+	assert.Nil(t, err)
+
+	// Multi-byte runes to ensure chunks are not split mid-rune.
+	message := strings.Repeat("é", MaxMessageBytes)
+
+	assert.Nil(t, client.Add("group", "stream", line(time.Now(), message)))
+
+	lines := client.Groups["group"]["stream"]
+	assert.Len(t, lines, 3)
+
+	var reassembled string
+
+	for i, line := range lines {
+		assert.LessOrEqual(t, len(*line.Event.Message), MaxMessageBytes)
+
+		prefix, chunk, _ := strings.Cut(*line.Event.Message, "] ")
+		assert.True(t, strings.HasSuffix(prefix, []string{" 1/3", " 2/3", " 3/3"}[i]))
+
+		reassembled += chunk
+	}
+
+	assert.Equal(t, message, reassembled)
+}
+
+func TestOversizeDeadLetter(t *testing.T) {
+	var (
+		rejected []string
+		sources  []string
+	)
+
+	client, err := New(&loggertest.API{}, Config{
+		Oversize: OversizeDeadLetter,
+		Rejected: func(group, stream string, line Line, reason string) {
+			rejected = append(rejected, reason)
+			sources = append(sources, line.Source.Pod)
+		},
+	})
+	assert.Nil(t, err)
+
+	oversized := line(time.Now(), strings.Repeat("a", MaxMessageBytes+1))
+	oversized.Kubernetes.Pod = "web"
+
+	assert.Nil(t, client.Add("group", "stream", oversized))
+	assert.Nil(t, client.Add("group", "stream", line(time.Now(), "ok")))
+
+	// The Kubernetes metadata is kept so the line can be dead-lettered.
+	assert.Equal(t, []string{ReasonOversize}, rejected)
+	assert.Equal(t, []string{"web"}, sources)
+	assert.Len(t, client.Groups["group"]["stream"], 1)
+}
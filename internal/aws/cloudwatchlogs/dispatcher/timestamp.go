@@ -0,0 +1,34 @@
+package dispatcher
+
+import (
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+// TimePolicy for events which are outside of the window CloudWatch Logs accepts.
+type TimePolicy string
+
+const (
+	// TimeDrop discards the event.
+	TimeDrop TimePolicy = "drop"
+	// TimeClamp replaces the timestamp of the event with the current time.
+	TimeClamp TimePolicy = "clamp"
+	// TimeDeadLetter diverts the event to the dead-letter handler.
+	TimeDeadLetter TimePolicy = "deadletter"
+)
+
+const (
+	// DefaultMaxAge is the oldest event CloudWatch Logs accepts.
+	DefaultMaxAge = 14 * 24 * time.Hour
+	// DefaultMaxFuture is the furthest in the future an event CloudWatch Logs accepts.
+	DefaultMaxFuture = 2 * time.Hour
+)
+
+// Counts for each outcome of the time policy.
+var timestampEvents = metrics.NewCounter("timestamp_events_total", "Events outside of the window CloudWatch Logs accepts, by policy.", "policy")
+
+// TimePolicies which can be configured.
+func TimePolicies() []string {
+	return []string{string(TimeDrop), string(TimeClamp), string(TimeDeadLetter)}
+}
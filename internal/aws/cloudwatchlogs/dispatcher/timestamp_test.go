@@ -0,0 +1,57 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+)
+
+func TestTimeDrop(t *testing.T) {
+	client, err := New(&loggertest.API{}, Config{Time: TimeDrop})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(-15*24*time.Hour), "old")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(3*time.Hour), "new")))
+	assert.Nil(t, client.Add("group", "stream", line(now, "ok")))
+
+	assert.Equal(t, []string{"ok"}, lineMessages(client.Groups["group"]["stream"]))
+}
+
+func TestTimeClamp(t *testing.T) {
+	client, err := New(&loggertest.API{}, Config{Time: TimeClamp, MaxAge: time.Hour})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(-2*time.Hour), "old")))
+
+	lines := client.Groups["group"]["stream"]
+	assert.Len(t, lines, 1)
+	assert.GreaterOrEqual(t, *lines[0].Event.Timestamp, now.UnixMilli())
+}
+
+func TestTimeDeadLetter(t *testing.T) {
+	var rejected []string
+
+	client, err := New(&loggertest.API{}, Config{
+		Time: TimeDeadLetter,
+		Rejected: func(group, stream string, line Line, reason string) {
+			rejected = append(rejected, reason)
+		},
+	})
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(-15*24*time.Hour), "old")))
+	assert.Nil(t, client.Add("group", "stream", line(now.Add(3*time.Hour), "new")))
+
+	assert.Equal(t, []string{logger.ReasonTooOld, logger.ReasonTooNew}, rejected)
+	assert.Empty(t, client.Groups["group"]["stream"])
+}
@@ -0,0 +1,82 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache of log groups and streams which are known to exist.
+//
+// A nil cache is valid and treats every group and stream as unknown.
+type Cache struct {
+	// How long an entry is trusted before it is created again.
+	ttl time.Duration
+	// Lock to protect entries.
+	lock sync.Mutex
+	// Expiry of each known group and stream.
+	entries map[string]time.Time
+}
+
+// NewCache returns a cache where entries expire after the ttl.
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Exists returns true if the key is known to exist and has not expired.
+func (c *Cache) Exists(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiry, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expiry) {
+		delete(c.entries, key)
+		return false
+	}
+
+	return true
+}
+
+// Add a key which is known to exist.
+func (c *Cache) Add(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[key] = time.Now().Add(c.ttl)
+}
+
+// Delete a key which is no longer known to exist.
+func (c *Cache) Delete(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, key)
+}
+
+// GroupKey returns the cache key for a log group.
+func GroupKey(group string) string {
+	return group
+}
+
+// StreamKey returns the cache key for a log stream.
+func StreamKey(group, stream string) string {
+	return group + ":" + stream
+}
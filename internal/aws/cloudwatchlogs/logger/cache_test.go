@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+)
+
+func TestCache(t *testing.T) {
+	api := &loggertest.API{}
+	cache := NewCache(time.Hour)
+
+	// Groups and streams are only created once.
+	for i := 0; i < 3; i++ {
+		_, err := New(context.TODO(), api, cache, "group", "stream", 10)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 1, api.Groups)
+	assert.Equal(t, 1, api.Streams)
+
+	// A new stream in the same group only creates the stream.
+	_, err := New(context.TODO(), api, cache, "group", "other", 10)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, api.Groups)
+	assert.Equal(t, 2, api.Streams)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := NewCache(-time.Second)
+	cache.Add("group")
+	assert.False(t, cache.Exists("group"))
+
+	var disabled *Cache
+	disabled.Add("group")
+	assert.False(t, disabled.Exists("group"))
+}
+
+func TestCacheNotFound(t *testing.T) {
+	api := &loggertest.API{}
+	cache := NewCache(time.Hour)
+
+	client, err := New(context.TODO(), api, cache, "group", "stream", 10)
+	assert.Nil(t, err)
+
+	// The stream was deleted after it was cached.
+	api.NotFound = true
+
+	assert.Nil(t, client.Add(context.TODO(), event(time.Now(), "foo")))
+	assert.Nil(t, client.Flush(context.TODO()))
+
+	assert.Equal(t, 2, api.Groups)
+	assert.Equal(t, 2, api.Streams)
+	assert.Len(t, api.Batches, 1)
+}
@@ -4,56 +4,152 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+const (
+	// MaxBatchEvents is the maximum number of events CloudWatch Logs accepts in a single PutLogEvents call.
+	MaxBatchEvents = 10000
+	// MaxBatchBytes is the maximum size of a PutLogEvents call, calculated as the sum of all messages plus EventOverhead for each event.
+	MaxBatchBytes = 1048576
+	// MaxEventBytes is the maximum size of a single event, calculated as the size of the message plus EventOverhead.
+	MaxEventBytes = 262144
+	// EventOverhead is the amount of bytes CloudWatch Logs adds to the size of each event.
+	EventOverhead = 26
+	// MaxBatchSpan is the maximum time between the earliest and latest event in a single PutLogEvents call.
+	MaxBatchSpan = 24 * time.Hour
+)
+
+const (
+	// ReasonTooOld is given for events which are older than CloudWatch Logs accepts.
+	ReasonTooOld = "too_old"
+	// ReasonTooNew is given for events which are further in the future than CloudWatch Logs accepts.
+	ReasonTooNew = "too_new"
+	// ReasonExpired is given for events which are older than the retention period of the log group.
+	ReasonExpired = "expired"
 )
 
+var (
+	rejectedEvents = metrics.NewCounter("rejected_events_total", "Events which CloudWatch Logs did not accept, by reason.", "reason")
+	putDuration    = metrics.NewHistogram("put_log_events_duration_seconds", "Latency of PutLogEvents calls.", metrics.DefaultBuckets)
+	putErrors      = metrics.NewCounter("put_log_events_errors_total", "PutLogEvents calls which failed, by error code.", "code")
+	batchEvents    = metrics.NewHistogram("batch_events", "Amount of events in each PutLogEvents call.", []float64{1, 10, 50, 100, 250, 500, 1000, 2500, 5000, 10000})
+	bytesSent      = metrics.NewCounter("bytes_sent_total", "Bytes of events accepted by PutLogEvents, as calculated by CloudWatch Logs.")
+)
+
+// API for interacting with CloudWatch Logs.
+type API interface {
+	CreateLogGroup(ctx context.Context, params *cloudwatchlogs.CreateLogGroupInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
+}
+
 // Client client for handling log events.
 type Client struct {
 	// Client for interacting with CloudWatch Logs.
-	client *cloudwatchlogs.Client
+	client API
+	// Cache of log groups and streams which are known to exist.
+	cache *Cache
 	// Group which events will be pushed to.
 	Group string
 	// Stream which events will be pushed to.
 	Stream string
+	// Rejected is called with events which CloudWatch Logs did not accept.
+	Rejected func(event types.InputLogEvent, reason string)
+	// Retry configuration for pushing events.
+	Retry Retry
 	// Amount of events to keep before flushing.
 	batchSize int
 	// Events stored in memory before being pushed.
 	events []types.InputLogEvent
+	// Size of the events stored in memory, as calculated by CloudWatch Logs.
+	bytes int
+	// Earliest and latest timestamps of the events stored in memory.
+	earliest, latest int64
 	// Lock to ensure logs are
 	lock sync.Mutex
 }
 
 // New client which creates the log group, stream and returns a client for batching logs to it.
-func New(ctx context.Context, client *cloudwatchlogs.Client, group, stream string, batchSize int) (*Client, error) {
+//
+// Groups and streams which are in the cache are not created again.
+func New(ctx context.Context, client API, cache *Cache, group, stream string, batchSize int) (*Client, error) {
 	batch := &Client{
 		Group:     group,
 		Stream:    stream,
 		client:    client,
+		cache:     cache,
 		batchSize: batchSize,
 	}
 
-	err := PutLogGroup(ctx, client, group)
+	err := batch.create(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	err = PutLogStream(ctx, client, group, stream)
-	if err != nil {
-		return nil, err
+	return batch, nil
+}
+
+// Helper function to create the log group and stream if they are not known to exist.
+func (c *Client) create(ctx context.Context) error {
+	if !c.cache.Exists(GroupKey(c.Group)) {
+		err := PutLogGroup(ctx, c.client, c.Group)
+		if err != nil {
+			return err
+		}
+
+		c.cache.Add(GroupKey(c.Group))
 	}
 
-	return batch, nil
+	if !c.cache.Exists(StreamKey(c.Group, c.Stream)) {
+		err := PutLogStream(ctx, c.client, c.Group, c.Stream)
+		if err != nil {
+			return err
+		}
+
+		c.cache.Add(StreamKey(c.Group, c.Stream))
+	}
+
+	return nil
 }
 
 // Add event to the client.
+//
+// Events are flushed before a batch would exceed the batch size or any of the
+// PutLogEvents limits for event count, payload size or time span.
 func (c *Client) Add(ctx context.Context, event types.InputLogEvent) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	size := len(aws.ToString(event.Message)) + EventOverhead
+	timestamp := aws.ToInt64(event.Timestamp)
+
+	if len(c.events) > 0 && (c.bytes+size > MaxBatchBytes || c.exceedsSpan(timestamp)) {
+		err := c.flush(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.events) == 0 || timestamp < c.earliest {
+		c.earliest = timestamp
+	}
+
+	if len(c.events) == 0 || timestamp > c.latest {
+		c.latest = timestamp
+	}
+
 	c.events = append(c.events, event)
+	c.bytes += size
 
-	if len(c.events) >= c.batchSize {
-		return c.Flush(ctx)
+	if len(c.events) >= c.batchSize || len(c.events) >= MaxBatchEvents {
+		return c.flush(ctx)
 	}
 
 	return nil
@@ -64,6 +160,15 @@ func (c *Client) Flush(ctx context.Context) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	return c.flush(ctx)
+}
+
+// Helper function to flush events which assumes the lock is held.
+func (c *Client) flush(ctx context.Context) error {
+	if len(c.events) == 0 {
+		return nil
+	}
+
 	input := &cloudwatchlogs.PutLogEventsInput{
 		LogGroupName:  aws.String(c.Group),
 		LogStreamName: aws.String(c.Stream),
@@ -72,22 +177,109 @@ func (c *Client) Flush(ctx context.Context) error {
 
 	// Reset the logs back to
 	c.events = []types.InputLogEvent{}
+	c.bytes = 0
 
 	return c.putLogEvents(ctx, input)
 }
 
-// PutLogEvents will attempt to execute and handle invalid tokens.
+// Helper function to determine if adding a timestamp would exceed the maximum time span of a batch.
+func (c *Client) exceedsSpan(timestamp int64) bool {
+	earliest, latest := min(c.earliest, timestamp), max(c.latest, timestamp)
+	return latest-earliest > MaxBatchSpan.Milliseconds()
+}
+
+// Helper function to disable the SDK's own retries for calls which are retried by Retry,
+// otherwise the attempts would multiply.
+func withoutRetries(o *cloudwatchlogs.Options) {
+	o.Retryer = aws.NopRetryer{}
+}
+
+// PutLogEvents will attempt to execute and retry transient errors.
 func (c *Client) putLogEvents(ctx context.Context, input *cloudwatchlogs.PutLogEventsInput) error {
-	_, err := c.client.PutLogEvents(ctx, input)
+	var output *cloudwatchlogs.PutLogEventsOutput
+
+	put := func() error {
+		start := time.Now()
+
+		var err error
+		output, err = c.client.PutLogEvents(ctx, input, withoutRetries)
+
+		putDuration.Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			putErrors.Inc(errorCode(err))
+		}
+
+		return err
+	}
+
+	err := c.Retry.Do(ctx, put)
+
+	// The group or stream was deleted after it was cached, create it again and retry.
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		c.cache.Delete(GroupKey(c.Group))
+		c.cache.Delete(StreamKey(c.Group, c.Stream))
+
+		err = c.create(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = c.Retry.Do(ctx, put)
+	}
+
 	if err != nil {
 		return err
 	}
 
+	batchEvents.Observe(float64(len(input.LogEvents)))
+	bytesSent.Add(float64(size(input.LogEvents)))
+
+	if output.RejectedLogEventsInfo != nil {
+		c.rejected(input.LogEvents, output.RejectedLogEventsInfo)
+	}
+
 	return nil
 }
 
+// Helper function to calculate the size of events as calculated by CloudWatch Logs.
+func size(events []types.InputLogEvent) int {
+	var total int
+
+	for _, event := range events {
+		total += len(aws.ToString(event.Message)) + EventOverhead
+	}
+
+	return total
+}
+
+// Helper function to report events which CloudWatch Logs did not accept.
+func (c *Client) rejected(events []types.InputLogEvent, info *types.RejectedLogEventsInfo) {
+	for i, event := range events {
+		var reason string
+
+		switch {
+		case info.TooNewLogEventStartIndex != nil && int32(i) >= *info.TooNewLogEventStartIndex:
+			reason = ReasonTooNew
+		case info.TooOldLogEventEndIndex != nil && int32(i) < *info.TooOldLogEventEndIndex:
+			reason = ReasonTooOld
+		case info.ExpiredLogEventEndIndex != nil && int32(i) < *info.ExpiredLogEventEndIndex:
+			reason = ReasonExpired
+		default:
+			continue
+		}
+
+		rejectedEvents.Inc(reason)
+
+		if c.Rejected != nil {
+			c.Rejected(event, reason)
+		}
+	}
+}
+
 // PutLogGroup will attempt to create a log group and not return an error if it already exists.
-func PutLogGroup(ctx context.Context, client *cloudwatchlogs.Client, name string) error {
+func PutLogGroup(ctx context.Context, client API, name string) error {
 	_, err := client.CreateLogGroup(ctx, &cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: aws.String(name),
 	})
@@ -105,7 +297,7 @@ func PutLogGroup(ctx context.Context, client *cloudwatchlogs.Client, name string
 }
 
 // PutLogStream will attempt to create a log stream and not return an error if it already exists.
-func PutLogStream(ctx context.Context, client *cloudwatchlogs.Client, group, stream string) error {
+func PutLogStream(ctx context.Context, client API, group, stream string) error {
 	_, err := client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
 		LogGroupName:  aws.String(group),
 		LogStreamName: aws.String(stream),
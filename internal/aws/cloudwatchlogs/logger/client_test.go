@@ -0,0 +1,135 @@
+package logger
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+)
+
+// Helper function to create an event.
+func event(timestamp time.Time, message string) types.InputLogEvent {
+	return types.InputLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(timestamp.UnixMilli()),
+	}
+}
+
+func TestBatchCount(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(context.TODO(), api, nil, "group", "stream", 2)
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, client.Add(context.TODO(), event(now, "foo")))
+	}
+
+	assert.Nil(t, client.Flush(context.TODO()))
+
+	assert.Len(t, api.Batches, 3)
+	assert.Len(t, api.Batches[0], 2)
+	assert.Len(t, api.Batches[1], 2)
+	assert.Len(t, api.Batches[2], 1)
+
+	// Flushing an empty client does not push an empty batch.
+	assert.Nil(t, client.Flush(context.TODO()))
+	assert.Len(t, api.Batches, 3)
+}
+
+func TestBatchBytes(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(context.TODO(), api, nil, "group", "stream", MaxBatchEvents)
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	// Three messages which fit two to a batch once the overhead is included.
+	message := strings.Repeat("a", MaxBatchBytes/3)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, client.Add(context.TODO(), event(now, message)))
+	}
+
+	assert.Nil(t, client.Flush(context.TODO()))
+
+	assert.Len(t, api.Batches, 2)
+	assert.Len(t, api.Batches[0], 2)
+	assert.Len(t, api.Batches[1], 1)
+}
+
+func TestBatchSpan(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(context.TODO(), api, nil, "group", "stream", MaxBatchEvents)
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	assert.Nil(t, client.Add(context.TODO(), event(now.Add(-25*time.Hour), "old")))
+	assert.Nil(t, client.Add(context.TODO(), event(now.Add(-2*time.Hour), "recent")))
+	assert.Nil(t, client.Add(context.TODO(), event(now, "new")))
+
+	assert.Nil(t, client.Flush(context.TODO()))
+
+	assert.Len(t, api.Batches, 2)
+	assert.Len(t, api.Batches[0], 2)
+	assert.Len(t, api.Batches[1], 1)
+}
+
+func TestRejected(t *testing.T) {
+	api := &loggertest.API{
+		Output: cloudwatchlogs.PutLogEventsOutput{
+			RejectedLogEventsInfo: &types.RejectedLogEventsInfo{
+				ExpiredLogEventEndIndex:  aws.Int32(1),
+				TooOldLogEventEndIndex:   aws.Int32(2),
+				TooNewLogEventStartIndex: aws.Int32(4),
+			},
+		},
+	}
+
+	client, err := New(context.TODO(), api, nil, "group", "stream", MaxBatchEvents)
+	assert.Nil(t, err)
+
+	rejected := make(map[string]string)
+
+	client.Rejected = func(event types.InputLogEvent, reason string) {
+		rejected[*event.Message] = reason
+	}
+
+	now := time.Now()
+
+	for _, message := range []string{"0", "1", "2", "3", "4"} {
+		assert.Nil(t, client.Add(context.TODO(), event(now, message)))
+	}
+
+	assert.Nil(t, client.Flush(context.TODO()))
+
+	assert.Equal(t, map[string]string{
+		"0": ReasonTooOld,
+		"1": ReasonTooOld,
+		"4": ReasonTooNew,
+	}, rejected)
+}
+
+func TestPutWithoutSDKRetries(t *testing.T) {
+	api := &loggertest.API{}
+
+	client, err := New(context.TODO(), api, nil, "group", "stream", 1)
+	assert.Nil(t, err)
+
+	assert.Nil(t, client.Add(context.TODO(), event(time.Now(), "foo")))
+
+	// PutLogEvents is retried by Retry, so the SDK must not retry it as well.
+	assert.IsType(t, aws.NopRetryer{}, api.Options.Retryer)
+}
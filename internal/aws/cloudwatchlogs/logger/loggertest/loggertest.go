@@ -0,0 +1,91 @@
+// Package loggertest provides a fake CloudWatch Logs API for tests.
+package loggertest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// API which records the batches which were pushed.
+type API struct {
+	lock sync.Mutex
+	// Batches of events which were pushed.
+	Batches [][]types.InputLogEvent
+	// Output which will be returned by PutLogEvents.
+	Output cloudwatchlogs.PutLogEventsOutput
+	// Errors which will be returned by PutLogEvents, keyed by stream or group.
+	Errors map[string]error
+	// Returns a ResourceNotFoundException on the next PutLogEvents call.
+	NotFound bool
+	// Amount of calls to create groups and streams.
+	Groups, Streams int
+	// Options applied by the last PutLogEvents call.
+	Options cloudwatchlogs.Options
+}
+
+// CreateLogGroup counts the groups which were created.
+func (a *API) CreateLogGroup(ctx context.Context, params *cloudwatchlogs.CreateLogGroupInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.Groups++
+
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+// CreateLogStream counts the streams which were created.
+func (a *API) CreateLogStream(ctx context.Context, params *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.Streams++
+
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+// PutLogEvents records the batch which was pushed, or returns the error for its stream or group.
+func (a *API) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, fn := range optFns {
+		fn(&a.Options)
+	}
+
+	if a.NotFound {
+		a.NotFound = false
+		return nil, &types.ResourceNotFoundException{}
+	}
+
+	if err, ok := a.Errors[aws.ToString(params.LogStreamName)]; ok {
+		return nil, err
+	}
+
+	if err, ok := a.Errors[aws.ToString(params.LogGroupName)]; ok {
+		return nil, err
+	}
+
+	a.Batches = append(a.Batches, params.LogEvents)
+
+	return &a.Output, nil
+}
+
+// Messages of all the events which were pushed, in the order they were pushed.
+func (a *API) Messages() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var messages []string
+
+	for _, batch := range a.Batches {
+		for _, event := range batch {
+			messages = append(messages, aws.ToString(event.Message))
+		}
+	}
+
+	return messages
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+// Retry configuration for calls to CloudWatch Logs.
+type Retry struct {
+	// Attempts which will be made before giving up. A single attempt is made when zero.
+	Attempts int
+	// BaseDelay before the first retry, doubled for each retry after that.
+	BaseDelay time.Duration
+	// MaxDelay between retries.
+	MaxDelay time.Duration
+}
+
+var retries = metrics.NewCounter("retries_total", "Calls to CloudWatch Logs which were retried, by error code.", "code")
+
+// Error codes which are safe to retry, in addition to the SDK's defaults.
+var retryableCodes = map[string]bool{
+	"ServiceUnavailableException": true,
+	"InternalFailure":             true,
+}
+
+// Retryable returns true if an error is transient and the call can be retried.
+//
+// The HTTP status is checked before the error code, so any 5xx or 429 response is
+// retried regardless of its code, along with the errors which the SDK would retry
+// eg. throttling codes and connection resets.
+func Retryable(err error) bool {
+	switch retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) {
+	case aws.TrueTernary:
+		return true
+	case aws.FalseTernary:
+		return false
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+
+		if status >= 500 || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return retryableCodes[apiErr.ErrorCode()]
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Helper function to return an error code which can be used to track retries.
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+
+	return "Unknown"
+}
+
+// Do calls fn until it succeeds, returns an error which is not retryable or all attempts have been made.
+func (r Retry) Do(ctx context.Context, fn func() error) error {
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !Retryable(err) || attempt+1 >= r.Attempts {
+			return err
+		}
+
+		retries.Inc(errorCode(err))
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(r.delay(attempt)):
+		}
+	}
+}
+
+// Helper function to calculate the delay before a retry using exponential backoff with full jitter.
+func (r Retry) delay(attempt int) time.Duration {
+	backoff := r.BaseDelay << attempt
+
+	if backoff <= 0 || (r.MaxDelay > 0 && backoff > r.MaxDelay) {
+		backoff = r.MaxDelay
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, Retryable(&types.ThrottlingException{}))
+	assert.True(t, Retryable(&types.ServiceUnavailableException{}))
+	assert.False(t, Retryable(&types.InvalidParameterException{}))
+	assert.False(t, Retryable(errors.New("unknown")))
+
+	// Codes which CloudWatch Logs doesn't model are retried by their HTTP status.
+	assert.True(t, Retryable(response(503, &smithy.GenericAPIError{Code: "ServiceUnavailable"})))
+	assert.True(t, Retryable(response(500, &smithy.GenericAPIError{Code: "InternalServerError"})))
+	assert.True(t, Retryable(response(429, &smithy.GenericAPIError{Code: "SlowDownPlease"})))
+	assert.False(t, Retryable(response(400, &smithy.GenericAPIError{Code: "ValidationException"})))
+
+	// Throttling codes the SDK knows about.
+	assert.True(t, Retryable(&smithy.GenericAPIError{Code: "TooManyRequestsException"}))
+
+	// Transport errors.
+	assert.True(t, Retryable(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}))
+
+	// Calls which were cancelled are not retried.
+	assert.False(t, Retryable(context.Canceled))
+}
+
+// Helper function to wrap an error in an HTTP response with a status code.
+func response(status int, err error) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      err,
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	retry := Retry{
+		Attempts:  3,
+		BaseDelay: time.Millisecond,
+		MaxDelay:  time.Millisecond,
+	}
+
+	// Succeeds after a transient error.
+	var calls int
+
+	err := retry.Do(context.TODO(), func() error {
+		calls++
+
+		if calls == 1 {
+			return &types.ThrottlingException{}
+		}
+
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+
+	// Gives up once all attempts have been made.
+	calls = 0
+
+	err = retry.Do(context.TODO(), func() error {
+		calls++
+		return &types.ServiceUnavailableException{}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Does not retry errors which are not transient.
+	calls = 0
+
+	err = retry.Do(context.TODO(), func() error {
+		calls++
+		return &types.InvalidParameterException{}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
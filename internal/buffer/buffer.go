@@ -0,0 +1,163 @@
+package buffer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+)
+
+// ErrFull is returned when events cannot be added without exceeding the buffer limits.
+var ErrFull = errors.New("buffer is full")
+
+// Buffer of events which are waiting to be pushed, grouped by log group and stream.
+type Buffer struct {
+	// Maximum amount of events which can be buffered for a single stream.
+	maxStream int
+	// Maximum amount of events which can be buffered across all streams.
+	maxTotal int
+	// Lock to protect the streams.
+	lock sync.Mutex
+	// Events which are waiting to be pushed.
+	streams map[key]*stream
+	// Amount of events across all streams.
+	total int
+}
+
+// Key which identifies a stream.
+type key struct {
+	group  string
+	stream string
+}
+
+// Events which are waiting to be pushed to a stream.
+type stream struct {
+	lines dispatcher.Lines
+	// When the oldest events in the stream were buffered.
+	since time.Time
+}
+
+// New buffer which holds at most maxStream events per stream and maxTotal events overall.
+// Limits which are zero are unlimited.
+func New(maxStream, maxTotal int) *Buffer {
+	return &Buffer{
+		maxStream: maxStream,
+		maxTotal:  maxTotal,
+		streams:   make(map[key]*stream),
+	}
+}
+
+// Add events to the buffer. Either all events are added or ErrFull is returned.
+func (b *Buffer) Add(groups map[string]dispatcher.Streams) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var total int
+
+	for group, streams := range groups {
+		for name, lines := range streams {
+			total += len(lines)
+
+			if s, ok := b.streams[key{group, name}]; ok && b.maxStream > 0 && len(s.lines)+len(lines) > b.maxStream {
+				return ErrFull
+			}
+
+			if b.maxStream > 0 && len(lines) > b.maxStream {
+				return ErrFull
+			}
+		}
+	}
+
+	if b.maxTotal > 0 && b.total+total > b.maxTotal {
+		return ErrFull
+	}
+
+	now := time.Now()
+
+	for group, streams := range groups {
+		for name, lines := range streams {
+			k := key{group, name}
+
+			if _, ok := b.streams[k]; !ok {
+				b.streams[k] = &stream{since: now}
+			}
+
+			b.streams[k].lines = append(b.streams[k].lines, lines...)
+		}
+	}
+
+	b.total += total
+
+	return nil
+}
+
+// Requeue events which failed to push so they are pushed ahead of newer events.
+// Requeued events are always accepted, even if they exceed the buffer limits.
+func (b *Buffer) Requeue(group, name string, lines dispatcher.Lines) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	k := key{group, name}
+
+	s, ok := b.streams[k]
+	if !ok {
+		s = &stream{since: time.Now()}
+		b.streams[k] = s
+	}
+
+	s.lines = append(append(dispatcher.Lines{}, lines...), s.lines...)
+	b.total += len(lines)
+}
+
+// Ready removes and returns streams which have at least size events or were buffered more than age ago.
+func (b *Buffer) Ready(size int, age time.Duration) map[string]dispatcher.Streams {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	return b.take(func(s *stream) bool {
+		return len(s.lines) >= size || now.Sub(s.since) >= age
+	})
+}
+
+// Drain removes and returns all streams.
+func (b *Buffer) Drain() map[string]dispatcher.Streams {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.take(func(s *stream) bool {
+		return true
+	})
+}
+
+// Len returns the amount of events in the buffer.
+func (b *Buffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.total
+}
+
+// Helper function to remove and return streams which match a filter, assumes the lock is held.
+func (b *Buffer) take(filter func(s *stream) bool) map[string]dispatcher.Streams {
+	groups := make(map[string]dispatcher.Streams)
+
+	for k, s := range b.streams {
+		if !filter(s) {
+			continue
+		}
+
+		if _, ok := groups[k.group]; !ok {
+			groups[k.group] = make(dispatcher.Streams)
+		}
+
+		groups[k.group][k.stream] = s.lines
+		b.total -= len(s.lines)
+
+		delete(b.streams, k)
+	}
+
+	return groups
+}
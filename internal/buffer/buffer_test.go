@@ -0,0 +1,78 @@
+package buffer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+)
+
+// Helper function to create lines with the given messages.
+func lines(messages ...string) dispatcher.Lines {
+	var l dispatcher.Lines
+
+	for _, m := range messages {
+		l = append(l, dispatcher.Line{Event: types.InputLogEvent{Message: aws.String(m), Timestamp: aws.Int64(0)}})
+	}
+
+	return l
+}
+
+func TestAddFull(t *testing.T) {
+	b := New(3, 4)
+
+	assert.Nil(t, b.Add(map[string]dispatcher.Streams{
+		"group": {"a": lines("1", "2")},
+	}))
+
+	// Exceeds the stream limit.
+	assert.ErrorIs(t, b.Add(map[string]dispatcher.Streams{
+		"group": {"a": lines("3", "4")},
+	}), ErrFull)
+
+	// Exceeds the total limit, nothing is added.
+	assert.ErrorIs(t, b.Add(map[string]dispatcher.Streams{
+		"group": {"b": lines("1", "2"), "c": lines("1")},
+	}), ErrFull)
+
+	assert.Equal(t, 2, b.Len())
+}
+
+func TestReady(t *testing.T) {
+	b := New(0, 0)
+
+	assert.Nil(t, b.Add(map[string]dispatcher.Streams{
+		"group": {"big": lines("1", "2", "3"), "small": lines("1")},
+	}))
+
+	// Only streams which reached the size are ready.
+	ready := b.Ready(3, time.Hour)
+	assert.Len(t, ready["group"], 1)
+	assert.Len(t, ready["group"]["big"], 3)
+	assert.Equal(t, 1, b.Len())
+
+	// Streams which have been buffered for long enough are ready.
+	ready = b.Ready(3, 0)
+	assert.Len(t, ready["group"]["small"], 1)
+	assert.Equal(t, 0, b.Len())
+}
+
+func TestRequeue(t *testing.T) {
+	b := New(1, 1)
+
+	assert.Nil(t, b.Add(map[string]dispatcher.Streams{
+		"group": {"a": lines("new")},
+	}))
+
+	// Requeued events are accepted beyond the limits and pushed first.
+	b.Requeue("group", "a", lines("old"))
+
+	drained := b.Drain()
+	assert.Equal(t, "old", *drained["group"]["a"][0].Event.Message)
+	assert.Equal(t, "new", *drained["group"]["a"][1].Event.Message)
+	assert.Equal(t, 0, b.Len())
+}
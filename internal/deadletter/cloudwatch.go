@@ -0,0 +1,84 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+)
+
+// CloudWatch sink which pushes records as JSON to a fallback log group.
+type CloudWatch struct {
+	// Client for interacting with CloudWatch Logs.
+	Client logger.API
+	// Cache of log groups and streams which are known to exist.
+	Cache *logger.Cache
+	// Group which records are pushed to.
+	Group string
+	// Stream which records are pushed to.
+	Stream string
+	// Retry configuration for pushing records.
+	Retry logger.Retry
+}
+
+// Write records to the fallback log group.
+//
+// Events are timestamped with the time they were dead-lettered because the original
+// timestamp may be outside of the window CloudWatch Logs accepts. The original
+// timestamp is kept in the record.
+func (c *CloudWatch) Write(ctx context.Context, records []Record) error {
+	l, err := logger.New(ctx, c.Client, c.Cache, c.Group, c.Stream, logger.MaxBatchEvents)
+	if err != nil {
+		return err
+	}
+
+	l.Retry = c.Retry
+
+	for _, record := range records {
+		message, err := encode(record)
+		if err != nil {
+			return err
+		}
+
+		timestamp := record.DeadLettered
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+
+		err = l.Add(ctx, types.InputLogEvent{
+			Message:   aws.String(message),
+			Timestamp: aws.Int64(timestamp.UnixMilli()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.Flush(ctx)
+}
+
+// Helper function to encode a record, shortening the log so it fits in a single event.
+func encode(record Record) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	limit := logger.MaxEventBytes - logger.EventOverhead
+
+	// Removing a byte from the log removes at least a byte from the encoded record.
+	for len(data) > limit && record.Log != "" {
+		record.Log = record.Log[:max(0, len(record.Log)-(len(data)-limit))]
+
+		data, err = json.Marshal(record)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,59 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+const (
+	// ReasonUnrouted is given for lines which could not be routed to a log group.
+	ReasonUnrouted = "unrouted"
+	// ReasonUndecodable is given for records which could not be decoded, the raw record is kept as the log.
+	ReasonUndecodable = "undecodable"
+	// ReasonUndeliverable is given for lines which CloudWatch Logs failed to accept.
+	ReasonUndeliverable = "undeliverable"
+	// ReasonAbandoned is given for lines which were not pushed before the process shut down.
+	ReasonAbandoned = "abandoned"
+)
+
+// Record which could not be delivered to CloudWatch Logs.
+//
+// The timestamp, log and kubernetes fields match the lines shipped by Fluent Bit
+// so records can be replayed.
+type Record struct {
+	Timestamp  time.Time            `json:"timestamp"`
+	Log        string               `json:"log"`
+	Kubernetes fluentbit.Kubernetes `json:"kubernetes"`
+	// Group and stream the record was destined for, if it was routed.
+	Group  string `json:"group,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	// Reason the record could not be delivered.
+	Reason string `json:"reason"`
+	// Error which caused the record to be undeliverable.
+	Error string `json:"error,omitempty"`
+	// When the record was dead-lettered.
+	DeadLettered time.Time `json:"dead_lettered"`
+}
+
+// Sink which records which could not be delivered are written to.
+type Sink interface {
+	// Write records to the sink. It may be called from multiple goroutines at the same time.
+	Write(ctx context.Context, records []Record) error
+}
+
+// Multi sink which writes records to every sink.
+type Multi []Sink
+
+// Write records to every sink, returning the errors of any sinks which failed.
+func (m Multi) Write(ctx context.Context, records []Record) error {
+	var errs []error
+
+	for _, sink := range m {
+		errs = append(errs, sink.Write(ctx, records))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,80 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Helper function to read records from a file.
+func read(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	var records []Record
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletter.ndjson")
+
+	f, err := NewFile(path, 0, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, f.Write(context.TODO(), []Record{
+		{
+			Log:        "foo",
+			Kubernetes: fluentbit.Kubernetes{Namespace: "default", Pod: "web"},
+			Reason:     ReasonUnrouted,
+		},
+	}))
+	assert.Nil(t, f.Close())
+
+	records := read(t, path)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "foo", records[0].Log)
+	assert.Equal(t, "web", records[0].Kubernetes.Pod)
+	assert.Equal(t, ReasonUnrouted, records[0].Reason)
+}
+
+func TestFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletter.ndjson")
+
+	f, err := NewFile(path, 10, 2)
+	assert.Nil(t, err)
+
+	for _, log := range []string{"one", "two", "three", "four"} {
+		assert.Nil(t, f.Write(context.TODO(), []Record{{Log: log}}))
+	}
+	assert.Nil(t, f.Close())
+
+	// Each record exceeds the size, so each is written to its own file and the oldest is removed.
+	assert.Equal(t, "four", read(t, path)[0].Log)
+	assert.Equal(t, "three", read(t, path+".1")[0].Log)
+	assert.Equal(t, "two", read(t, path+".2")[0].Log)
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestEncodeOversize(t *testing.T) {
+	message, err := encode(Record{Log: strings.Repeat("\x00", logger.MaxEventBytes)})
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(message), logger.MaxEventBytes-logger.EventOverhead)
+}
@@ -0,0 +1,36 @@
+// Package deadlettertest provides a fake dead-letter sink for tests.
+package deadlettertest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+)
+
+// Sink which records the records which were dead-lettered.
+type Sink struct {
+	lock sync.Mutex
+	// Records which were written.
+	Records []deadletter.Record
+	// Amount of calls to Write.
+	Writes int
+	// Error which will be returned by Write instead of recording the records.
+	Err error
+}
+
+// Write records the records, or returns Err.
+func (s *Sink) Write(ctx context.Context, records []deadletter.Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Writes++
+
+	if s.Err != nil {
+		return s.Err
+	}
+
+	s.Records = append(s.Records, records...)
+
+	return nil
+}
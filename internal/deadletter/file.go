@@ -0,0 +1,144 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File sink which writes records as newline delimited JSON.
+//
+// The file is rotated once it exceeds its maximum size, keeping a limited amount
+// of rotated files named with a numeric suffix eg. deadletter.ndjson.1
+type File struct {
+	// Path of the file which records are written to.
+	path string
+	// Size at which the file is rotated. Never rotated when zero.
+	maxSize int64
+	// Amount of rotated files which are kept.
+	maxFiles int
+	// Lock to protect the fields below.
+	lock sync.Mutex
+	// File which records are written to.
+	file *os.File
+	// Size of the file which records are written to.
+	size int64
+}
+
+// NewFile sink which writes records to a path.
+func NewFile(path string, maxSize int64, maxFiles int) (*File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Write records to the file.
+func (f *File) Write(ctx context.Context, records []Record) error {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(buf.Len()) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return fmt.Errorf("failed to rotate dead-letter file: %w", err)
+		}
+	}
+
+	n, err := f.file.Write(buf.Bytes())
+	f.size += int64(n)
+
+	return err
+}
+
+// Close the file.
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file.Close()
+}
+
+// Helper function to open the file for appending, assumes the lock is held.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// Helper function to shift rotated files along and start a new file, assumes the lock is held.
+func (f *File) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(f.rotated(f.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i := f.maxFiles - 1; i > 0; i-- {
+		err = os.Rename(f.rotated(i), f.rotated(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if f.maxFiles > 0 {
+		err = os.Rename(f.path, f.rotated(1))
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Helper function to return the path of a rotated file.
+func (f *File) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
@@ -0,0 +1,94 @@
+package fluentbit
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"sync"
+)
+
+// Decoder which streams lines from a payload one at a time.
+type Decoder interface {
+	// Next line in the payload. Returns io.EOF once all lines have been read.
+	Next() (Line, error)
+}
+
+// Format which Fluent Bit can use to ship lines.
+type Format struct {
+	// Name of the format as configured in Fluent Bit eg. "json_lines".
+	Name string
+	// ContentTypes which will select this format when no format is configured.
+	ContentTypes []string
+	// NewDecoder returns a decoder for a payload in this format.
+	NewDecoder func(r io.Reader) Decoder
+}
+
+var (
+	// Lock to protect the format registry.
+	formatsLock sync.RWMutex
+	// Formats which have been registered, keyed by name.
+	formats = make(map[string]Format)
+)
+
+// Register a format so it can be looked up by name or content type.
+func Register(format Format) {
+	formatsLock.Lock()
+	defer formatsLock.Unlock()
+
+	if _, ok := formats[format.Name]; ok {
+		panic(fmt.Sprintf("format already registered: %s", format.Name))
+	}
+
+	formats[format.Name] = format
+}
+
+// Lookup a format by name.
+func Lookup(name string) (Format, error) {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	format, ok := formats[name]
+	if !ok {
+		return Format{}, fmt.Errorf("format not found: %s", name)
+	}
+
+	return format, nil
+}
+
+// LookupContentType finds the format which is registered for a Content-Type header.
+func LookupContentType(contentType string) (Format, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Format{}, fmt.Errorf("invalid content type: %w", err)
+	}
+
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	for _, format := range formats {
+		for _, t := range format.ContentTypes {
+			if t == mediaType {
+				return format, nil
+			}
+		}
+	}
+
+	return Format{}, fmt.Errorf("format not found for content type: %s", mediaType)
+}
+
+// Formats returns the names of all registered formats.
+func Formats() []string {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	var names []string
+
+	for name := range formats {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
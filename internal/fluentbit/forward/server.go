@@ -0,0 +1,427 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/msgpack"
+)
+
+// Handler which flushes lines received from Fluent Bit.
+type Handler func(ctx context.Context, decoder fluentbit.Decoder) error
+
+// Server for receiving messages from the Fluent Bit "forward" output.
+//
+// Supports Message, Forward, PackedForward and CompressedPackedForward modes.
+// When Fluent Bit requests an ack (Require_ack_response) it is only sent once
+// the Handler has returned without an error, providing at-least-once delivery.
+type Server struct {
+	// Handler which lines are passed to.
+	Handler Handler
+	// Maximum size of a message, and of CompressedPackedForward entries once they have been decompressed.
+	// Unlimited when zero.
+	MaxMessageSize int64
+	// Maximum time to wait for the next message, including an idle connection waiting for
+	// its first byte. Unlimited when zero.
+	ReadTimeout time.Duration
+	// Toggles on debugging.
+	Debug bool
+	// Lock to protect the fields below.
+	lock sync.Mutex
+	// Listeners which connections are accepted from.
+	listeners map[net.Listener]struct{}
+	// Open connections and whether they are processing a message.
+	conns map[net.Conn]bool
+	// Cancels the context of each open connection.
+	cancels map[net.Conn]context.CancelFunc
+	// Set once the server is shutting down.
+	shutdown bool
+	// Connections which are being handled.
+	wg sync.WaitGroup
+}
+
+// ErrServerClosed is returned by Serve once the server has been shut down.
+var ErrServerClosed = errors.New("forward: server closed")
+
+// ListenAndServe listens on a "tcp://host:port" or "unix:///path/to/socket" address.
+func (s *Server) ListenAndServe(addr string) error {
+	network, address := "tcp", addr
+
+	if strings.HasPrefix(addr, "unix://") {
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+
+		// Remove a socket which was left behind by a previous process.
+		err := removeSocket(address)
+		if err != nil {
+			return err
+		}
+	}
+
+	address = strings.TrimPrefix(address, "tcp://")
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Helper function to remove a stale socket, refusing to remove anything which is not a socket.
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("refusing to remove %s because it is not a socket", path)
+	}
+
+	return os.Remove(path)
+}
+
+// Serve connections accepted by the listener.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	s.lock.Lock()
+
+	if s.shutdown {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for messages which are being processed.
+//
+// Idle connections are closed straight away. Connections which are still processing a
+// message when the context is done are closed without an ack, prompting Fluent Bit to retry.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+
+	s.shutdown = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+
+	for conn, active := range s.conns {
+		if !active {
+			conn.Close()
+		}
+	}
+
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for conn := range s.conns {
+			s.cancels[conn]()
+			conn.Close()
+		}
+		s.lock.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// Helper function to check if the server is shutting down.
+func (s *Server) closing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.shutdown
+}
+
+// Helper function to start tracking a connection. Returns false if the server is shutting down.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+
+	if s.cancels == nil {
+		s.cancels = make(map[net.Conn]context.CancelFunc)
+	}
+
+	s.conns[conn] = false
+	s.cancels[conn] = func() {}
+	s.wg.Add(1)
+
+	return true
+}
+
+// Helper function to mark a connection as processing a message or idle.
+// Returns false if the server is shutting down and the connection should be closed.
+func (s *Server) active(conn net.Conn, active bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	s.conns[conn] = active
+
+	return true
+}
+
+// Helper function to process messages from a connection until it is closed.
+func (s *Server) handle(conn net.Conn) {
+	// Messages which are being processed are cancelled once the connection is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.lock.Lock()
+	s.cancels[conn] = cancel
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		delete(s.cancels, conn)
+		s.lock.Unlock()
+
+		cancel()
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	decoder := msgpack.NewDecoder(conn)
+	decoder.MaxSize = s.MaxMessageSize
+
+	for {
+		if s.ReadTimeout > 0 {
+			err := conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+			if err != nil {
+				log.Println("Failed to set forward read deadline:", err)
+				return
+			}
+		}
+
+		v, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+
+		// Fluent Bit reconnects when it has more messages to send.
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if s.Debug {
+				log.Println("Closing forward connection which timed out:", err)
+			}
+
+			return
+		}
+
+		if err != nil {
+			if !s.closing() {
+				log.Println("Failed to read forward message:", err)
+			}
+
+			return
+		}
+
+		// Messages which arrive after shutting down are not acked so Fluent Bit retries them.
+		if !s.active(conn, true) {
+			return
+		}
+
+		chunk, err := s.message(ctx, v)
+		if err != nil {
+			// Closing the connection without an ack prompts Fluent Bit to retry.
+			log.Println("Failed to process forward message:", err)
+			return
+		}
+
+		if chunk == "" {
+			if !s.active(conn, false) {
+				return
+			}
+
+			continue
+		}
+
+		ack := msgpack.AppendMapHeader(nil, 1)
+		ack = msgpack.AppendString(ack, "ack")
+		ack = msgpack.AppendString(ack, chunk)
+
+		_, err = conn.Write(ack)
+		if err != nil {
+			log.Println("Failed to send forward ack:", err)
+			return
+		}
+
+		if !s.active(conn, false) {
+			return
+		}
+	}
+}
+
+// Helper function to pass a message to the handler and return the chunk id to ack (if requested).
+func (s *Server) message(ctx context.Context, v interface{}) (string, error) {
+	msg, ok := v.([]interface{})
+	if !ok || len(msg) < 2 {
+		return "", fmt.Errorf("message is not a [tag, entries, option] array")
+	}
+
+	var (
+		decoder fluentbit.Decoder
+		option  interface{}
+	)
+
+	switch entries := msg[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		decoder = &entriesDecoder{entries: entries}
+		option = index(msg, 2)
+
+	case string, []byte:
+		// PackedForward and CompressedPackedForward mode: [tag, msgpack stream, option]
+		option = index(msg, 2)
+
+		r, err := s.packed(entries, option)
+		if err != nil {
+			return "", err
+		}
+
+		decoder = msgpack.NewEventDecoder(r)
+
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(msg) < 3 {
+			return "", fmt.Errorf("message mode requires a time and record")
+		}
+
+		decoder = &entriesDecoder{entries: []interface{}{[]interface{}{msg[1], msg[2]}}}
+		option = index(msg, 3)
+	}
+
+	if s.Debug {
+		log.Printf("Received forward message with tag: %v\n", msg[0])
+	}
+
+	err := s.Handler(ctx, decoder)
+	if err != nil {
+		return "", err
+	}
+
+	if o, ok := option.(map[string]interface{}); ok {
+		if chunk, ok := o["chunk"].(string); ok {
+			return chunk, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Helper function to return a reader for PackedForward entries.
+func (s *Server) packed(entries, option interface{}) (io.Reader, error) {
+	var data []byte
+
+	switch e := entries.(type) {
+	case string:
+		data = []byte(e)
+	case []byte:
+		data = e
+	}
+
+	if o, ok := option.(map[string]interface{}); ok {
+		switch o["compressed"] {
+		case nil, "text":
+		case "gzip":
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+
+			// Compressed entries are small on the wire, so limit them once decompressed.
+			return fluentbit.LimitReader(r, s.MaxMessageSize), nil
+		default:
+			return nil, fmt.Errorf("unsupported compression: %v", o["compressed"])
+		}
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// Helper function to return the value at an index of a message, or nil if it is not set.
+func index(msg []interface{}, i int) interface{} {
+	if i >= len(msg) {
+		return nil
+	}
+
+	return msg[i]
+}
+
+// Decoder for entries which have already been decoded from a message.
+type entriesDecoder struct {
+	entries []interface{}
+}
+
+// Next line in the list of entries.
+func (d *entriesDecoder) Next() (fluentbit.Line, error) {
+	if len(d.entries) == 0 {
+		return fluentbit.Line{}, io.EOF
+	}
+
+	entry := d.entries[0]
+	d.entries = d.entries[1:]
+
+	return msgpack.Event(entry)
+}
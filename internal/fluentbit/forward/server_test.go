@@ -0,0 +1,325 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/msgpack"
+)
+
+// Helper function to encode a [time, record] entry.
+func entry(b []byte, timestamp int64, log string) []byte {
+	b = msgpack.AppendArrayHeader(b, 2)
+	b = msgpack.AppendInt(b, timestamp)
+	b = msgpack.AppendMapHeader(b, 1)
+	b = msgpack.AppendString(b, "log")
+	return msgpack.AppendString(b, log)
+}
+
+// Helper function to encode an option map which requests an ack.
+func chunk(b []byte, id string, compressed bool) []byte {
+	if compressed {
+		b = msgpack.AppendMapHeader(b, 2)
+		b = msgpack.AppendString(b, "compressed")
+		b = msgpack.AppendString(b, "gzip")
+	} else {
+		b = msgpack.AppendMapHeader(b, 1)
+	}
+
+	b = msgpack.AppendString(b, "chunk")
+	return msgpack.AppendString(b, id)
+}
+
+// Helper function to run a server against one end of a pipe.
+func serve(t *testing.T, handler Handler) net.Conn {
+	return serveWith(t, &Server{
+		Handler: handler,
+	})
+}
+
+// Helper function to run a configured server against one end of a pipe.
+func serveWith(t *testing.T, s *Server) net.Conn {
+	server, client := net.Pipe()
+
+	s.track(server)
+	go s.handle(server)
+
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return client
+}
+
+// Helper function to read an ack from the server.
+func readAck(t *testing.T, conn net.Conn) string {
+	v, err := msgpack.NewDecoder(conn).Decode()
+	assert.Nil(t, err)
+
+	return v.(map[string]interface{})["ack"].(string)
+}
+
+func TestModes(t *testing.T) {
+	received := make(chan []string, 1)
+
+	conn := serve(t, func(ctx context.Context, decoder fluentbit.Decoder) error {
+		var logs []string
+
+		for {
+			line, err := decoder.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+
+			logs = append(logs, line.Log)
+		}
+
+		received <- logs
+
+		return nil
+	})
+
+	// Message mode.
+	msg := msgpack.AppendArrayHeader(nil, 4)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendInt(msg, 1600000000)
+	msg = msgpack.AppendMapHeader(msg, 1)
+	msg = msgpack.AppendString(msg, "log")
+	msg = msgpack.AppendString(msg, "message")
+	msg = chunk(msg, "one", false)
+
+	go conn.Write(msg)
+	assert.Equal(t, []string{"message"}, <-received)
+	assert.Equal(t, "one", readAck(t, conn))
+
+	// Forward mode.
+	msg = msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendArrayHeader(msg, 2)
+	msg = entry(msg, 1600000000, "forward1")
+	msg = entry(msg, 1600000001, "forward2")
+	msg = chunk(msg, "two", false)
+
+	go conn.Write(msg)
+	assert.Equal(t, []string{"forward1", "forward2"}, <-received)
+	assert.Equal(t, "two", readAck(t, conn))
+
+	// PackedForward mode.
+	var stream []byte
+	stream = entry(stream, 1600000000, "packed1")
+	stream = entry(stream, 1600000001, "packed2")
+
+	msg = msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendBytes(msg, stream)
+	msg = chunk(msg, "three", false)
+
+	go conn.Write(msg)
+	assert.Equal(t, []string{"packed1", "packed2"}, <-received)
+	assert.Equal(t, "three", readAck(t, conn))
+
+	// CompressedPackedForward mode.
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(stream)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	msg = msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendBytes(msg, compressed.Bytes())
+	msg = chunk(msg, "four", true)
+
+	go conn.Write(msg)
+	assert.Equal(t, []string{"packed1", "packed2"}, <-received)
+	assert.Equal(t, "four", readAck(t, conn))
+}
+
+func TestNoAckOnFailure(t *testing.T) {
+	conn := serve(t, func(ctx context.Context, decoder fluentbit.Decoder) error {
+		return fmt.Errorf("failed")
+	})
+
+	msg := msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendArrayHeader(msg, 1)
+	msg = entry(msg, 1600000000, "forward")
+	msg = chunk(msg, "one", false)
+
+	go conn.Write(msg)
+
+	// The connection is closed instead of being acked.
+	_, err := msgpack.NewDecoder(conn).Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := &Server{
+		Handler: func(ctx context.Context, decoder fluentbit.Decoder) error {
+			return nil
+		},
+	}
+
+	served := make(chan error)
+
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Wait for the connection to be accepted.
+	assert.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.conns) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, s.Shutdown(context.TODO()))
+	assert.ErrorIs(t, <-served, ErrServerClosed)
+
+	// The idle connection was closed.
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestPackedLimit(t *testing.T) {
+	var compressed bytes.Buffer
+
+	// A small message which decompresses to 1 MiB.
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(bytes.Repeat([]byte{0xc0}, 1<<20))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	s := &Server{
+		MaxMessageSize: 1024,
+	}
+
+	r, err := s.packed(compressed.Bytes(), map[string]interface{}{"compressed": "gzip"})
+	assert.Nil(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, fluentbit.ErrTooLarge)
+}
+
+func TestMessageLimit(t *testing.T) {
+	conn := serveWith(t, &Server{
+		Handler: func(ctx context.Context, decoder fluentbit.Decoder) error {
+			t.Error("handler was called for a message which is too large")
+			return nil
+		},
+		MaxMessageSize: 1024,
+	})
+
+	// A Forward mode message which is larger than the limit.
+	msg := msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "tag")
+	msg = msgpack.AppendArrayHeader(msg, 1)
+	msg = entry(msg, 1, string(bytes.Repeat([]byte("a"), 2048)))
+	msg = chunk(msg, "a", false)
+
+	go conn.Write(msg)
+
+	// The connection was closed without an ack.
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestReadTimeout(t *testing.T) {
+	conn := serveWith(t, &Server{
+		Handler: func(ctx context.Context, decoder fluentbit.Decoder) error {
+			return nil
+		},
+		ReadTimeout: 50 * time.Millisecond,
+	})
+
+	// Only part of a message is sent.
+	_, err := conn.Write(msgpack.AppendArrayHeader(nil, 3))
+	assert.Nil(t, err)
+
+	// The connection was closed once the deadline passed.
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRemoveSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// Files which are not sockets are left alone.
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0o600))
+	assert.NotNil(t, removeSocket(file))
+	assert.FileExists(t, file)
+
+	// Sockets left behind by a previous process are removed.
+	socket := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.Nil(t, l.Close())
+	assert.Nil(t, removeSocket(socket))
+	assert.NoFileExists(t, socket)
+
+	// Paths which don't exist are ignored.
+	assert.Nil(t, removeSocket(filepath.Join(dir, "missing")))
+}
+
+func TestShutdownCancelsMessage(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	s := &Server{
+		Handler: func(ctx context.Context, decoder fluentbit.Decoder) error {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		},
+	}
+
+	conn := serveWith(t, s)
+
+	msg := msgpack.AppendArrayHeader(nil, 3)
+	msg = msgpack.AppendString(msg, "kube.test")
+	msg = msgpack.AppendArrayHeader(msg, 1)
+	msg = entry(msg, 1600000000, "forward")
+	msg = chunk(msg, "one", false)
+
+	go conn.Write(msg)
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// The message which is being processed is cancelled once the grace period is over.
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
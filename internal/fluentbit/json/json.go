@@ -1,18 +1,169 @@
 package json
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+const (
+	// Format for a single JSON array of records eg. [{...},{...}].
+	Format = "json"
+	// FormatLines for newline delimited records eg. {...}\n{...}.
+	FormatLines = "json_lines"
+	// FormatStream for concatenated records eg. {...}{...}.
+	FormatStream = "json_stream"
 )
 
-// Parse "json" payloads seny by Fluent Bit.
-func Parse(r io.Reader) ([]Line, error) {
-	var l []Line
+func init() {
+	// Fluent Bit sends application/json for json_lines and json_stream too, so the payload is sniffed.
+	fluentbit.Register(fluentbit.Format{
+		Name:         Format,
+		ContentTypes: []string{"application/json"},
+		NewDecoder:   NewDetectDecoder,
+	})
+
+	fluentbit.Register(fluentbit.Format{
+		Name:         FormatLines,
+		ContentTypes: []string{"application/x-ndjson", "application/jsonlines"},
+		NewDecoder:   NewStreamDecoder,
+	})
+
+	fluentbit.Register(fluentbit.Format{
+		Name:         FormatStream,
+		ContentTypes: []string{"application/stream+json"},
+		NewDecoder:   NewStreamDecoder,
+	})
+}
+
+// Decoder for "json" payloads sent by Fluent Bit.
+type Decoder struct {
+	decoder *json.Decoder
+	// Tracks if the opening bracket of the array has been read.
+	started bool
+}
+
+// NewDecoder returns a decoder which streams lines from a JSON array.
+func NewDecoder(r io.Reader) fluentbit.Decoder {
+	return &Decoder{
+		decoder: json.NewDecoder(r),
+	}
+}
+
+// Next line in the array.
+func (d *Decoder) Next() (fluentbit.Line, error) {
+	var line fluentbit.Line
+
+	if !d.started {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return line, err
+		}
+
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return line, fmt.Errorf("expected start of array but found: %v", token)
+		}
+
+		d.started = true
+	}
+
+	if !d.decoder.More() {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return line, err
+		}
+
+		if delim, ok := token.(json.Delim); !ok || delim != ']' {
+			return line, fmt.Errorf("expected end of array but found: %v", token)
+		}
+
+		return line, io.EOF
+	}
+
+	err := d.decoder.Decode(&line)
+	if err != nil {
+		return line, err
+	}
+
+	return line, nil
+}
+
+// StreamDecoder for "json_lines" and "json_stream" payloads sent by Fluent Bit.
+type StreamDecoder struct {
+	decoder *json.Decoder
+}
+
+// NewStreamDecoder returns a decoder which streams lines from a sequence of JSON objects.
+func NewStreamDecoder(r io.Reader) fluentbit.Decoder {
+	return &StreamDecoder{
+		decoder: json.NewDecoder(r),
+	}
+}
+
+// Next line in the sequence.
+func (d *StreamDecoder) Next() (fluentbit.Line, error) {
+	var line fluentbit.Line
 
-	err := json.NewDecoder(r).Decode(&l)
+	err := d.decoder.Decode(&line)
 	if err != nil {
-		return l, err
+		return line, err
 	}
 
-	return l, nil
+	return line, nil
+}
+
+// DetectDecoder for payloads which are either a JSON array or a sequence of JSON objects.
+type DetectDecoder struct {
+	reader  *bufio.Reader
+	decoder fluentbit.Decoder
+}
+
+// NewDetectDecoder returns a decoder which streams lines from a JSON array when the payload starts
+// with "[", otherwise from a sequence of JSON objects.
+func NewDetectDecoder(r io.Reader) fluentbit.Decoder {
+	return &DetectDecoder{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// Next line in the payload.
+func (d *DetectDecoder) Next() (fluentbit.Line, error) {
+	if d.decoder == nil {
+		array, err := d.array()
+		if err != nil {
+			return fluentbit.Line{}, err
+		}
+
+		if array {
+			d.decoder = NewDecoder(d.reader)
+		} else {
+			d.decoder = NewStreamDecoder(d.reader)
+		}
+	}
+
+	return d.decoder.Next()
+}
+
+// Helper function to check if the first non-whitespace character starts an array.
+func (d *DetectDecoder) array() (bool, error) {
+	for {
+		b, err := d.reader.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			d.reader.ReadByte()
+		default:
+			return b[0] == '[', nil
+		}
+	}
 }
@@ -0,0 +1,85 @@
+package json
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Helper function to read all lines from a decoder.
+func readAll(d fluentbit.Decoder) ([]fluentbit.Line, error) {
+	var lines []fluentbit.Line
+
+	for {
+		line, err := d.Next()
+		if err == io.EOF {
+			return lines, nil
+		}
+
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	lines, err := readAll(NewDecoder(strings.NewReader(`[{"log":"foo","kubernetes":{"container_name":"nginx"}},{"log":"bar"}]`)))
+	assert.Nil(t, err)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "foo", lines[0].Log)
+	assert.Equal(t, "nginx", lines[0].Kubernetes.Container)
+	assert.Equal(t, "bar", lines[1].Log)
+
+	_, err = readAll(NewDecoder(strings.NewReader(`{"log":"foo"}`)))
+	assert.NotNil(t, err)
+}
+
+func TestStreamDecoder(t *testing.T) {
+	// Lines.
+	lines, err := readAll(NewStreamDecoder(strings.NewReader("{\"log\":\"foo\"}\n{\"log\":\"bar\"}\n")))
+	assert.Nil(t, err)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "foo", lines[0].Log)
+	assert.Equal(t, "bar", lines[1].Log)
+
+	// Stream.
+	lines, err = readAll(NewStreamDecoder(strings.NewReader(`{"log":"foo"}{"log":"bar"}`)))
+	assert.Nil(t, err)
+	assert.Len(t, lines, 2)
+}
+
+func TestDetectDecoder(t *testing.T) {
+	// Array.
+	lines, err := readAll(NewDetectDecoder(strings.NewReader(` [{"log":"foo"},{"log":"bar"}]`)))
+	assert.Nil(t, err)
+	assert.Len(t, lines, 2)
+
+	// Lines.
+	lines, err = readAll(NewDetectDecoder(strings.NewReader("\n{\"log\":\"foo\"}\n{\"log\":\"bar\"}\n")))
+	assert.Nil(t, err)
+	assert.Len(t, lines, 2)
+
+	// Empty.
+	lines, err = readAll(NewDetectDecoder(strings.NewReader("")))
+	assert.Nil(t, err)
+	assert.Empty(t, lines)
+}
+
+func TestLookupContentType(t *testing.T) {
+	format, err := fluentbit.LookupContentType("application/json; charset=utf-8")
+	assert.Nil(t, err)
+	assert.Equal(t, Format, format.Name)
+
+	format, err = fluentbit.LookupContentType("application/x-ndjson")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatLines, format.Name)
+
+	_, err = fluentbit.LookupContentType("text/plain")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,46 @@
+package fluentbit
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrTooLarge is returned when a (decompressed) payload exceeds the configured limit.
+var ErrTooLarge = errors.New("payload too large")
+
+// Reader which returns ErrTooLarge once more than the limit has been read.
+type limitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// LimitReader limits the amount of data which can be read from a payload. Unlimited when n is zero.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	if n <= 0 {
+		return r
+	}
+
+	return &limitReader{r: r, remaining: n}
+}
+
+// Read from the underlying reader until the limit is exceeded.
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+
+	// Read one byte past the limit so we can tell the difference between
+	// a payload which is exactly the limit and one which exceeds it.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	if l.remaining < 0 {
+		return n + int(l.remaining), ErrTooLarge
+	}
+
+	return n, err
+}
@@ -0,0 +1,18 @@
+package fluentbit
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitReader(t *testing.T) {
+	body, err := io.ReadAll(LimitReader(strings.NewReader("12345"), 5))
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(body))
+
+	_, err = io.ReadAll(LimitReader(strings.NewReader("123456"), 5))
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
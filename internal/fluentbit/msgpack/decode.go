@@ -0,0 +1,343 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+const (
+	// ExtEventTime is the extension type Fluent Bit uses for nanosecond precision timestamps.
+	ExtEventTime = 0
+	// Lengths are declared before the data is read, so allocations are limited to this size up
+	// front and grown as the data arrives. Otherwise a small payload could declare a huge length.
+	maxPrealloc = 64 * 1024
+	// Amount of array and map elements which are allocated up front.
+	maxPreallocElements = 1024
+	// MaxDepth of nested arrays and maps. Values are decoded recursively, so deeper payloads
+	// are rejected instead of exhausting the stack.
+	MaxDepth = 100
+)
+
+// ErrMaxDepth is returned when a value is nested deeper than MaxDepth.
+var ErrMaxDepth = fmt.Errorf("msgpack value nested deeper than %d levels", MaxDepth)
+
+// Ext is an extension value which is not natively understood by the decoder.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+// Decoder for reading msgpack values from a stream.
+type Decoder struct {
+	// Maximum amount of bytes a single value can be read from. Unlimited when zero.
+	MaxSize int64
+	r       *bufio.Reader
+	depth   int
+	read    int64
+}
+
+// NewDecoder returns a decoder which reads values from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Decode the next value from the stream.
+//
+// Values are returned as nil, bool, int64, uint64, float64, string, []byte,
+// []interface{}, map[string]interface{}, time.Time (EventTime) or Ext.
+// io.EOF is returned when the stream ends cleanly between values and
+// fluentbit.ErrTooLarge once a value is larger than MaxSize.
+func (d *Decoder) Decode() (interface{}, error) {
+	d.read = 0
+
+	return d.next()
+}
+
+// Helper function to decode the next value, which could be nested in an array or map.
+func (d *Decoder) next() (interface{}, error) {
+	code, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := d.value(code)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return v, err
+}
+
+// Helper function to decode a value based on its leading byte.
+func (d *Decoder) value(code byte) (interface{}, error) {
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code >= 0x80 && code <= 0x8f:
+		return d.mapN(int(code & 0x0f))
+	case code >= 0x90 && code <= 0x9f:
+		return d.arrayN(int(code & 0x0f))
+	case code >= 0xa0 && code <= 0xbf:
+		return d.str(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(code - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(code - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		b, err := d.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.bytes(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return uint64(bigEndian(b)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := d.bytes(1 << (code - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		return signExtend(bigEndian(b), len(b)), nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (code - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(code - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(code - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayN(n)
+	case 0xde, 0xdf:
+		n, err := d.length(code - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.mapN(n)
+	}
+
+	return nil, fmt.Errorf("unsupported msgpack type: 0x%x", code)
+}
+
+// Helper function to read a 1, 2 or 4 byte length (size 0, 1 or 2 respectively).
+func (d *Decoder) length(size byte) (int, error) {
+	b, err := d.bytes(1 << size)
+	if err != nil {
+		return 0, err
+	}
+
+	n := bigEndian(b)
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("length too large: %d", n)
+	}
+
+	return int(n), nil
+}
+
+// Helper function to account for n bytes of the current value before they are read.
+func (d *Decoder) consume(n int) error {
+	d.read += int64(n)
+
+	if d.MaxSize > 0 && d.read > d.MaxSize {
+		return fluentbit.ErrTooLarge
+	}
+
+	return nil
+}
+
+// Helper function to read a single byte.
+func (d *Decoder) readByte() (byte, error) {
+	if err := d.consume(1); err != nil {
+		return 0, err
+	}
+
+	return d.r.ReadByte()
+}
+
+// Helper function to read exactly n bytes.
+func (d *Decoder) bytes(n int) ([]byte, error) {
+	if err := d.consume(n); err != nil {
+		return nil, err
+	}
+
+	if n <= maxPrealloc {
+		b := make([]byte, n)
+
+		_, err := io.ReadFull(d.r, b)
+		if err != nil {
+			return nil, err
+		}
+
+		return b, nil
+	}
+
+	var buf bytes.Buffer
+
+	buf.Grow(maxPrealloc)
+
+	_, err := io.CopyN(&buf, d.r, int64(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Helper function to read a string of n bytes.
+func (d *Decoder) str(n int) (string, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Helper function to track nesting when entering an array or map.
+func (d *Decoder) enter() error {
+	if d.depth >= MaxDepth {
+		return ErrMaxDepth
+	}
+
+	d.depth++
+
+	return nil
+}
+
+// Helper function to read an array of n values.
+func (d *Decoder) arrayN(n int) ([]interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	values := make([]interface{}, 0, min(n, maxPreallocElements))
+
+	for i := 0; i < n; i++ {
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// Helper function to read a map of n key/value pairs.
+func (d *Decoder) mapN(n int) (map[string]interface{}, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+
+	values := make(map[string]interface{}, min(n, maxPreallocElements))
+
+	for i := 0; i < n; i++ {
+		k, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		values[keyString(k)] = v
+	}
+
+	return values, nil
+}
+
+// Helper function to read an extension value with n bytes of data.
+func (d *Decoder) ext(n int) (interface{}, error) {
+	t, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(t) == ExtEventTime && len(data) == 8 {
+		sec := binary.BigEndian.Uint32(data[0:4])
+		nsec := binary.BigEndian.Uint32(data[4:8])
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	}
+
+	return Ext{Type: int8(t), Data: data}, nil
+}
+
+// Helper function to convert a map key into a string.
+func keyString(k interface{}) string {
+	switch v := k.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Helper function to read a big endian unsigned integer of up to 8 bytes.
+func bigEndian(b []byte) uint64 {
+	var n uint64
+
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return n
+}
+
+// Helper function to sign extend an integer which was read from size bytes.
+func signExtend(n uint64, size int) int64 {
+	shift := uint(64 - size*8)
+	return int64(n<<shift) >> shift
+}
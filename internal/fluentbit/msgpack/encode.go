@@ -0,0 +1,75 @@
+package msgpack
+
+import (
+	"encoding/binary"
+)
+
+// AppendMapHeader appends the header for a map with n key/value pairs.
+func AppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 0x0f:
+		return append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// AppendString appends a str value.
+func AppendString(b []byte, s string) []byte {
+	n := len(s)
+
+	switch {
+	case n <= 0x1f:
+		b = append(b, 0xa0|byte(n))
+	case n <= 0xff:
+		b = append(b, 0xd9, byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+// AppendArrayHeader appends the header for an array with n values.
+func AppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 0x0f:
+		return append(b, 0x90|byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+// AppendInt appends an integer value.
+func AppendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n >= -32 && n < 0:
+		return append(b, byte(int8(n)))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+// AppendBytes appends a bin value.
+func AppendBytes(b []byte, data []byte) []byte {
+	n := len(data)
+
+	switch {
+	case n <= 0xff:
+		b = append(b, 0xc4, byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0xc5), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xc6), uint32(n))
+	}
+
+	return append(b, data...)
+}
@@ -0,0 +1,147 @@
+package msgpack
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+const (
+	// Format for msgpack payloads.
+	Format = "msgpack"
+	// ContentType sent by Fluent Bit when using "Format msgpack".
+	ContentType = "application/msgpack"
+)
+
+func init() {
+	fluentbit.Register(fluentbit.Format{
+		Name:         Format,
+		ContentTypes: []string{ContentType, "application/x-msgpack"},
+		NewDecoder:   NewEventDecoder,
+	})
+}
+
+// EventDecoder for "msgpack" payloads sent by Fluent Bit.
+//
+// The payload is a sequence of [timestamp, record] events. Fluent Bit 2.1+
+// sends [[timestamp, metadata], record] which is also supported.
+type EventDecoder struct {
+	decoder *Decoder
+}
+
+// NewEventDecoder returns a decoder which streams lines from msgpack events.
+func NewEventDecoder(r io.Reader) fluentbit.Decoder {
+	return &EventDecoder{
+		decoder: NewDecoder(r),
+	}
+}
+
+// Next line in the payload.
+func (d *EventDecoder) Next() (fluentbit.Line, error) {
+	v, err := d.decoder.Decode()
+	if err != nil {
+		return fluentbit.Line{}, err
+	}
+
+	return Event(v)
+}
+
+// Event converts a decoded [timestamp, record] event into a line.
+func Event(v interface{}) (fluentbit.Line, error) {
+	event, ok := v.([]interface{})
+	if !ok || len(event) != 2 {
+		return fluentbit.Line{}, fmt.Errorf("event is not a [timestamp, record] array")
+	}
+
+	header := event[0]
+
+	// Fluent Bit 2.1+ wraps the timestamp with metadata.
+	if h, ok := header.([]interface{}); ok {
+		if len(h) == 0 {
+			return fluentbit.Line{}, fmt.Errorf("event header is empty")
+		}
+
+		header = h[0]
+	}
+
+	timestamp, err := Timestamp(header)
+	if err != nil {
+		return fluentbit.Line{}, err
+	}
+
+	return Record(timestamp, event[1])
+}
+
+// Timestamp converts an EventTime, integer or float value into a time.
+func Timestamp(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case int64:
+		return time.Unix(t, 0).UTC(), nil
+	case uint64:
+		return time.Unix(int64(t), 0).UTC(), nil
+	case float64:
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported timestamp type: %T", v)
+}
+
+// Record converts a decoded record map into a line.
+func Record(timestamp time.Time, v interface{}) (fluentbit.Line, error) {
+	record, ok := v.(map[string]interface{})
+	if !ok {
+		return fluentbit.Line{}, fmt.Errorf("record is not a map")
+	}
+
+	line := fluentbit.Line{
+		Timestamp: timestamp,
+		Log:       stringValue(record["log"]),
+	}
+
+	if k, ok := record["kubernetes"].(map[string]interface{}); ok {
+		line.Kubernetes = fluentbit.Kubernetes{
+			Namespace:   stringValue(k["namespace_name"]),
+			Pod:         stringValue(k["pod_name"]),
+			Container:   stringValue(k["container_name"]),
+			Host:        stringValue(k["host"]),
+			Annotations: stringMap(k["annotations"]),
+			Labels:      stringMap(k["labels"]),
+		}
+	}
+
+	return line, nil
+}
+
+// Helper function to convert a str or bin value into a string.
+func stringValue(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	}
+
+	return ""
+}
+
+// Helper function to convert a map of str or bin values into a map of strings.
+func stringMap(v interface{}) map[string]string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	values := make(map[string]string, len(m))
+
+	for key, value := range m {
+		values[key] = stringValue(value)
+	}
+
+	return values
+}
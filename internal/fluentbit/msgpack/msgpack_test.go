@@ -0,0 +1,160 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Helper function to read all lines from a payload.
+func parse(payload []byte) ([]fluentbit.Line, error) {
+	var lines []fluentbit.Line
+
+	d := NewEventDecoder(bytes.NewReader(payload))
+
+	for {
+		line, err := d.Next()
+		if err == io.EOF {
+			return lines, nil
+		}
+
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+// Helper function to encode a short string.
+func fixstr(s string) []byte {
+	return append([]byte{0xa0 | byte(len(s))}, s...)
+}
+
+// Helper function to build a record with log and kubernetes metadata.
+func record(log string) []byte {
+	b := []byte{0x82}
+	b = append(b, fixstr("log")...)
+	b = append(b, fixstr(log)...)
+	b = append(b, fixstr("kubernetes")...)
+	b = append(b, 0x83)
+	b = append(b, fixstr("namespace_name")...)
+	b = append(b, fixstr("default")...)
+	b = append(b, fixstr("container_name")...)
+	b = append(b, fixstr("nginx")...)
+	b = append(b, fixstr("annotations")...)
+	b = append(b, 0x81)
+	b = append(b, fixstr("fluentbit.skpr.io/project")...)
+	b = append(b, fixstr("foo")...)
+	return b
+}
+
+func TestEventDecoder(t *testing.T) {
+	var payload []byte
+
+	// EventTime extension.
+	payload = append(payload, 0x92, 0xd7, 0x00, 0x5f, 0x5e, 0x10, 0x00, 0x00, 0x00, 0x00, 0x64)
+	payload = append(payload, record("first")...)
+
+	// Integer timestamp.
+	payload = append(payload, 0x92, 0xce, 0x5f, 0x5e, 0x10, 0x01)
+	payload = append(payload, record("second")...)
+
+	// Float timestamp.
+	payload = append(payload, 0x92, 0xcb, 0x41, 0xd7, 0xd7, 0x84, 0x00, 0xa0, 0x00, 0x00)
+	payload = append(payload, record("third")...)
+
+	// Fluent Bit 2.1+ [[timestamp, metadata], record].
+	payload = append(payload, 0x92, 0x92, 0xce, 0x5f, 0x5e, 0x10, 0x03, 0x80)
+	payload = append(payload, record("fourth")...)
+
+	lines, err := parse(payload)
+	assert.Nil(t, err)
+	assert.Len(t, lines, 4)
+
+	assert.Equal(t, time.Unix(1600000000, 100).UTC(), lines[0].Timestamp)
+	assert.Equal(t, "first", lines[0].Log)
+	assert.Equal(t, "default", lines[0].Kubernetes.Namespace)
+	assert.Equal(t, "nginx", lines[0].Kubernetes.Container)
+	assert.Equal(t, "foo", lines[0].Kubernetes.Annotations["fluentbit.skpr.io/project"])
+
+	assert.Equal(t, time.Unix(1600000001, 0).UTC(), lines[1].Timestamp)
+	assert.Equal(t, "second", lines[1].Log)
+
+	assert.Equal(t, time.Unix(1600000002, int64(500*time.Millisecond)).UTC(), lines[2].Timestamp)
+	assert.Equal(t, "third", lines[2].Log)
+
+	assert.Equal(t, time.Unix(1600000003, 0).UTC(), lines[3].Timestamp)
+	assert.Equal(t, "fourth", lines[3].Log)
+}
+
+func TestEventDecoderTruncated(t *testing.T) {
+	_, err := parse([]byte{0x92, 0xce, 0x5f})
+	assert.NotNil(t, err)
+}
+
+func TestDecodeLargeLength(t *testing.T) {
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+
+	// Declares 2 GiB of binary data but only provides a single byte.
+	_, err := NewDecoder(bytes.NewReader([]byte{0xc6, 0x7f, 0xff, 0xff, 0xff, 0x01})).Decode()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Declares a huge array but only provides a single element.
+	_, err = NewDecoder(bytes.NewReader([]byte{0xdd, 0x7f, 0xff, 0xff, 0xff, 0x01})).Decode()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	runtime.ReadMemStats(&after)
+
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestDecodeLargeString(t *testing.T) {
+	value := bytes.Repeat([]byte("a"), 3*maxPrealloc)
+
+	data := append([]byte{0xdb, 0x00, 0x03, 0x00, 0x00}, value...)
+
+	v, err := NewDecoder(bytes.NewReader(data)).Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, string(value), v)
+}
+
+func TestDecodeMaxDepth(t *testing.T) {
+	// Nested arrays well beyond the limit, which would otherwise overflow the stack.
+	payload := append(bytes.Repeat([]byte{0x91}, 20*1024*1024), 0xc0)
+
+	_, err := parse(payload)
+	assert.ErrorIs(t, err, ErrMaxDepth)
+
+	// Nesting up to the limit is still decoded.
+	v, err := NewDecoder(bytes.NewReader(append(bytes.Repeat([]byte{0x91}, MaxDepth), 0xc0))).Decode()
+	assert.Nil(t, err)
+	assert.NotNil(t, v)
+}
+
+func TestDecodeMaxSize(t *testing.T) {
+	data := append([]byte{0x92, 0xc0}, fixstr("too long")...)
+
+	d := NewDecoder(bytes.NewReader(append(data, data...)))
+	d.MaxSize = 4
+
+	_, err := d.Decode()
+	assert.ErrorIs(t, err, fluentbit.ErrTooLarge)
+
+	// The limit applies to each value rather than the whole stream.
+	d = NewDecoder(bytes.NewReader(append(data, data...)))
+	d.MaxSize = int64(len(data))
+
+	for i := 0; i < 2; i++ {
+		_, err = d.Decode()
+		assert.Nil(t, err)
+	}
+}
@@ -1,4 +1,4 @@
-package json
+package fluentbit
 
 import (
 	"time"
@@ -16,6 +16,7 @@ type Kubernetes struct {
 	Namespace   string            `json:"namespace_name"`
 	Pod         string            `json:"pod_name"`
 	Container   string            `json:"container_name"`
+	Host        string            `json:"host"`
 	Annotations map[string]string `json:"annotations"`
 	Labels      map[string]string `json:"labels"`
 }
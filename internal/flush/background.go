@@ -0,0 +1,91 @@
+package flush
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+)
+
+// Helper function to push buffered events which are ready, until the server is shut down.
+func (s *Server) background() {
+	defer s.loops.Done()
+
+	interval := min(s.BufferFlushInterval, time.Second)
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Pushes are cancelled when shutting down so the lines are drained instead.
+	ctx, cancel := s.context()
+	defer cancel()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.activity.beat("buffer")
+
+		groups := s.buffer.Ready(s.BufferFlushSize, s.BufferFlushInterval)
+		if len(groups) == 0 {
+			continue
+		}
+
+		s.push(ctx, groups)
+	}
+}
+
+// Helper function to push buffered events, requeuing streams which failed.
+func (s *Server) push(ctx context.Context, groups map[string]dispatcher.Streams) {
+	if s.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FlushTimeout)
+		defer cancel()
+	}
+
+	client, err := s.batch()
+	if err != nil {
+		log.Println("Failed to setup dispatcher:", err)
+		return
+	}
+
+	// Lines which are rejected or undeliverable are dead-lettered together.
+	defer client.deadLetter(ctx)
+
+	client.Groups = groups
+
+	err = client.Client.Send(ctx)
+	if err == nil {
+		return
+	}
+
+	log.Println("Failed to send buffered logs:", err)
+
+	var sendErr *dispatcher.SendError
+	if !errors.As(err, &sendErr) {
+		return
+	}
+
+	for _, failed := range sendErr.Failed {
+		// Errors which are not transient would fail again, so there is no point retrying them.
+		// Pushes which were cancelled or timed out are always retried.
+		if !logger.Retryable(failed.Err) && ctx.Err() == nil {
+			log.Printf("dropping %d buffered events for %s/%s because: %s\n", len(groups[failed.Group][failed.Stream]), failed.Group, failed.Stream, failed.Err)
+			recordsSkipped.Add(float64(len(groups[failed.Group][failed.Stream])), deadletter.ReasonUndeliverable)
+			client.add(undeliverable(failed.Group, failed.Stream, groups[failed.Group][failed.Stream], deadletter.ReasonUndeliverable, failed.Err)...)
+			continue
+		}
+
+		s.buffer.Requeue(failed.Group, failed.Stream, groups[failed.Group][failed.Stream])
+	}
+}
@@ -0,0 +1,142 @@
+package flush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+)
+
+// Batch of lines for a single flush.
+//
+// Lines which are rejected while routing or pushing are collected and dead-lettered together
+// once the flush has finished, instead of one at a time on the flush path.
+type Batch struct {
+	*dispatcher.Client
+	// Server which records are dead-lettered by.
+	server *Server
+	// Lock to protect records, which are added by concurrent pushes.
+	lock sync.Mutex
+	// Records which will be dead-lettered once the flush has finished.
+	records []deadletter.Record
+	// Amount of lines which will not be pushed, by reason.
+	skipped map[string]int
+}
+
+// Send lines to CloudWatch Logs and dead-letter lines which were rejected.
+func (b *Batch) Send(ctx context.Context) error {
+	err := b.Client.Send(ctx)
+
+	return errors.Join(err, b.deadLetter(ctx))
+}
+
+// Helper function to handle lines which will not be pushed to CloudWatch Logs.
+func (b *Batch) rejected(group, stream string, line dispatcher.Line, reason string) {
+	// Rejected lines are counted by records_skipped_total, logging each of them is too noisy.
+	if b.server.Debug {
+		log.Printf("dropping event for %s/%s because: %s\n", group, stream, reason)
+	}
+
+	b.skip(reason, 1)
+
+	b.add(undeliverable(group, stream, dispatcher.Lines{line}, reason, nil)...)
+}
+
+// Skipped returns the amount of lines which will not be pushed, by reason.
+func (b *Batch) Skipped() map[string]int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	skipped := make(map[string]int, len(b.skipped))
+
+	for reason, count := range b.skipped {
+		skipped[reason] = count
+	}
+
+	return skipped
+}
+
+// Helper function to count lines which will not be pushed.
+func (b *Batch) skip(reason string, count int) {
+	recordsSkipped.Add(float64(count), reason)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.skipped == nil {
+		b.skipped = make(map[string]int)
+	}
+
+	b.skipped[reason] += count
+}
+
+// Helper function to add records which will be dead-lettered once the flush has finished.
+func (b *Batch) add(records ...deadletter.Record) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.records = append(b.records, records...)
+}
+
+// Helper function to dead-letter the records which have been added.
+func (b *Batch) deadLetter(ctx context.Context) error {
+	b.lock.Lock()
+	records := b.records
+	b.records = nil
+	b.lock.Unlock()
+
+	return b.server.deadLetter(ctx, records)
+}
+
+// Helper function to write records which could not be delivered to the dead-letter sink.
+// Errors are logged and returned so callers which rely on the sink can fail.
+func (s *Server) deadLetter(ctx context.Context, records []deadletter.Record) error {
+	if s.DeadLetter == nil || len(records) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	for i := range records {
+		records[i].DeadLettered = now
+	}
+
+	err := s.DeadLetter.Write(ctx, records)
+	if err != nil {
+		log.Printf("Failed to write %d dead-letter records: %s\n", len(records), err)
+		return fmt.Errorf("failed to write %d dead-letter records: %w", len(records), err)
+	}
+
+	return nil
+}
+
+// Helper function to convert lines which could not be delivered into dead-letter records.
+func undeliverable(group, stream string, lines dispatcher.Lines, reason string, err error) []deadletter.Record {
+	var records []deadletter.Record
+
+	for _, line := range lines {
+		record := deadletter.Record{
+			Timestamp:  time.UnixMilli(aws.ToInt64(line.Event.Timestamp)),
+			Log:        aws.ToString(line.Event.Message),
+			Kubernetes: line.Source,
+			Group:      group,
+			Stream:     stream,
+			Reason:     reason,
+		}
+
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
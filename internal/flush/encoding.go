@@ -0,0 +1,123 @@
+package flush
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// ErrBodyTooLarge is returned when a (decompressed) request body exceeds the configured limit.
+var ErrBodyTooLarge = fluentbit.ErrTooLarge
+
+// ErrUnsupportedEncoding is returned when a request uses a Content-Encoding which cannot be decoded.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Stream identifier which starts the snappy framing format.
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// Helper function to wrap a request body with decompression based on the Content-Encoding header.
+// Bodies are limited to max bytes once decompressed, unlimited when zero.
+func decompress(encoding string, body io.Reader, max int64) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(fluentbit.LimitReader(body, max)), nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+
+		return limitCloser(r, max), nil
+	case "deflate":
+		r, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+
+		return limitCloser(r, max), nil
+	case "zstd":
+		options := []zstd.DOption{
+			zstd.WithDecoderConcurrency(1),
+		}
+
+		if max > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(max)))
+		}
+
+		r, err := zstd.NewReader(body, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return limitCloser(zstdReader{r.IOReadCloser()}, max), nil
+	case "snappy":
+		return unsnappy(body, max)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// Helper function to decompress a snappy body, which can either use the framing format or be a single block.
+func unsnappy(body io.Reader, max int64) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+
+	header, err := br.Peek(len(snappyMagic))
+	if err == nil && bytes.Equal(header, snappyMagic) {
+		return io.NopCloser(fluentbit.LimitReader(snappy.NewReader(br), max)), nil
+	}
+
+	// Blocks are smaller than their decoded length, so the limit also applies to the compressed body.
+	block, err := io.ReadAll(fluentbit.LimitReader(br, max))
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if max > 0 && int64(n) > max {
+		return nil, ErrBodyTooLarge
+	}
+
+	data, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Reader which reports the zstd decoder's own memory limit as ErrBodyTooLarge.
+type zstdReader struct {
+	io.ReadCloser
+}
+
+// Read from the zstd decoder.
+func (r zstdReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return n, ErrBodyTooLarge
+	}
+
+	return n, err
+}
+
+// Helper function to limit a reader which needs to be closed.
+func limitCloser(r io.ReadCloser, max int64) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{fluentbit.LimitReader(r, max), r}
+}
@@ -0,0 +1,78 @@
+package flush
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecompress(t *testing.T) {
+	const payload = `[{"log":"foo"}]`
+
+	var gzipped bytes.Buffer
+
+	w := gzip.NewWriter(&gzipped)
+	_, err := w.Write([]byte(payload))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	encoder, err := zstd.NewWriter(nil)
+	assert.Nil(t, err)
+
+	var framed bytes.Buffer
+
+	sw := snappy.NewBufferedWriter(&framed)
+	_, err = sw.Write([]byte(payload))
+	assert.Nil(t, err)
+	assert.Nil(t, sw.Close())
+
+	bodies := map[string][]byte{
+		"gzip":   gzipped.Bytes(),
+		"zstd":   encoder.EncodeAll([]byte(payload), nil),
+		"snappy": framed.Bytes(),
+	}
+
+	for encoding, compressed := range bodies {
+		r, err := decompress(encoding, bytes.NewReader(compressed), 0)
+		assert.Nil(t, err, encoding)
+
+		body, err := io.ReadAll(r)
+		assert.Nil(t, err, encoding)
+		assert.Equal(t, payload, string(body), encoding)
+		assert.Nil(t, r.Close())
+	}
+
+	// Snappy blocks are also supported.
+	r, err := decompress("snappy", bytes.NewReader(snappy.Encode(nil, []byte(payload))), 0)
+	assert.Nil(t, err)
+
+	body, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, string(body))
+
+	_, err = decompress("br", strings.NewReader(""), 0)
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 1<<20)
+
+	encoder, err := zstd.NewWriter(nil)
+	assert.Nil(t, err)
+
+	r, err := decompress("zstd", bytes.NewReader(encoder.EncodeAll(payload, nil)), 1024)
+	assert.Nil(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Snappy blocks declare their decoded length up front.
+	_, err = decompress("snappy", bytes.NewReader(snappy.Encode(nil, payload)), 1024)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
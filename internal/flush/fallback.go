@@ -0,0 +1,58 @@
+package flush
+
+import (
+	"errors"
+	"path"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+)
+
+// Reason which is recorded when a record is excluded from the fallback group.
+const reasonExcluded = "excluded"
+
+// Returned when a line cannot be named by the group template and its namespace is not shipped to the fallback group.
+var errExcluded = errors.New("namespace is excluded from the fallback group")
+
+// Fallback for lines which cannot be named by the group template eg. Pods without the project and environment annotations.
+type Fallback struct {
+	// Template for naming log groups.
+	Template *naming.Template
+	// Namespaces which are shipped, all namespaces are shipped when empty. Supports wildcards eg. kube-*
+	Include []string
+	// Namespaces which are not shipped, takes precedence over Include. Supports wildcards eg. kube-*
+	Exclude []string
+}
+
+// Ships returns true if lines from the namespace are shipped to the fallback group.
+func (f *Fallback) Ships(namespace string) bool {
+	if match(f.Exclude, namespace) {
+		return false
+	}
+
+	return len(f.Include) == 0 || match(f.Include, namespace)
+}
+
+// Helper function to determine the group name for a line, using the fallback when the group template fails.
+func (s *Server) groupName(data naming.Data) (string, error) {
+	group, err := groupName(s.GroupTemplate, data)
+	if err == nil || s.Fallback == nil {
+		return group, err
+	}
+
+	if !s.Fallback.Ships(data.Namespace) {
+		return "", errExcluded
+	}
+
+	return s.Fallback.Template.Execute(data)
+}
+
+// Helper function to check if a namespace matches any of the patterns.
+func match(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+
+	return false
+}
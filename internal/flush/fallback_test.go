@@ -0,0 +1,61 @@
+package flush
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter/deadlettertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+)
+
+func TestFallbackShips(t *testing.T) {
+	fallback := &Fallback{
+		Exclude: []string{"kube-node-lease"},
+	}
+
+	assert.True(t, fallback.Ships("default"))
+	assert.False(t, fallback.Ships("kube-node-lease"))
+
+	fallback.Include = []string{"kube-*", "ingress"}
+
+	assert.True(t, fallback.Ships("kube-system"))
+	assert.True(t, fallback.Ships("ingress"))
+	assert.False(t, fallback.Ships("default"))
+	assert.False(t, fallback.Ships("kube-node-lease"))
+}
+
+func TestRouteFallback(t *testing.T) {
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Prefix:  "prefix",
+		Cluster: "example",
+		Fallback: &Fallback{
+			Template: naming.MustParse("fallback", "/{{ .Prefix }}/{{ .Cluster }}/namespace/{{ .Namespace }}"),
+			Exclude:  []string{"kube-node-lease"},
+		},
+		DeadLetter: sink,
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	decoder := json.NewStreamDecoder(strings.NewReader(`
+{"timestamp":"` + now + `","log":"foo","kubernetes":{"namespace_name":"kube-system","pod_name":"coredns","container_name":"coredns"}}
+{"timestamp":"` + now + `","log":"bar","kubernetes":{"namespace_name":"kube-node-lease","pod_name":"lease","container_name":"lease"}}
+{"timestamp":"` + now + `","log":"baz","kubernetes":{"namespace_name":"default","container_name":"web","annotations":{"fluentbit.skpr.io/project":"foo","fluentbit.skpr.io/environment":"dev"}}}
+`))
+
+	client, err := server.Route(decoder)
+	assert.Nil(t, err)
+
+	// Excluded lines are not dead-lettered.
+	assert.Empty(t, sink.Records)
+
+	assert.Len(t, client.Groups, 2)
+	assert.Len(t, client.Groups["/prefix/example/namespace/kube-system"]["coredns"], 1)
+	assert.Len(t, client.Groups["/prefix/example/foo/dev"]["web"], 1)
+}
@@ -0,0 +1,104 @@
+package flush
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+const (
+	// Reason which is recorded when a record is dropped by the exclude or exclude-containers annotations.
+	reasonOptedOut = "opted_out"
+	// Reason which is recorded when a record is not kept by the sample rate.
+	reasonSampled = "sampled"
+)
+
+// Lines from the same container within this window are sampled together.
+const sampleWindow = time.Second
+
+// ErrSkipped is returned by Destinations when a line is dropped because of the Pod's annotations.
+var ErrSkipped = errors.New("skipped by annotations")
+
+// Helper function to check if a line should be dropped because of the Pod's annotations.
+// Returns the reason the line was dropped, or an empty string if it should be kept.
+func (s *Server) filter(line fluentbit.Line) string {
+	annotations := line.Kubernetes.Annotations
+
+	if value, ok := annotations[AnnotationExclude]; ok {
+		exclude, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			// Keep all lines instead of losing them because of a typo.
+			if s.Debug {
+				log.Printf("ignoring %s for %s/%s because: %s\n", AnnotationExclude, line.Kubernetes.Namespace, line.Kubernetes.Pod, err)
+			}
+		} else if exclude {
+			return reasonOptedOut
+		}
+	}
+
+	if containers, ok := annotations[AnnotationExcludeContainers]; ok {
+		for _, container := range strings.Split(containers, ",") {
+			if strings.TrimSpace(container) == line.Kubernetes.Container {
+				return reasonOptedOut
+			}
+		}
+	}
+
+	if value, ok := annotations[AnnotationSampleRate]; ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			// Keep all lines instead of losing them because of a typo.
+			if s.Debug {
+				log.Printf("ignoring %s for %s/%s because: %s\n", AnnotationSampleRate, line.Kubernetes.Namespace, line.Kubernetes.Pod, err)
+			}
+
+			return ""
+		}
+
+		if !sampled(line, rate) {
+			return reasonSampled
+		}
+	}
+
+	return ""
+}
+
+// Helper function to check if a line is kept by the sample rate.
+//
+// Lines are hashed by their container and the window their timestamp falls in, so the
+// lines of a multi-line message (eg. a stack trace) which Fluent Bit has not joined
+// together are kept or dropped together. The same line always gets the same decision,
+// eg. when it is pushed again from the write-ahead log or replayed.
+func sampled(line fluentbit.Line, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+
+	if rate <= 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(line.Kubernetes.Namespace + "/" + line.Kubernetes.Pod + "/" + line.Kubernetes.Container + "/"))
+	h.Write([]byte(strconv.FormatInt(line.Timestamp.Truncate(sampleWindow).Unix(), 10)))
+
+	return float64(mix(h.Sum64())) < rate*math.MaxUint64
+}
+
+// Helper function to spread a hash across all of its bits (the MurmurHash3 finalizer), as
+// FNV leaves the high bits poorly distributed for inputs which only differ at the end.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,120 @@
+package flush
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+func TestFilter(t *testing.T) {
+	server := &Server{}
+
+	line := func(container string, annotations map[string]string) fluentbit.Line {
+		return fluentbit.Line{
+			Timestamp: time.Now(),
+			Kubernetes: fluentbit.Kubernetes{
+				Namespace:   "default",
+				Pod:         "web",
+				Container:   container,
+				Annotations: annotations,
+			},
+		}
+	}
+
+	assert.Equal(t, "", server.filter(line("nginx", nil)))
+	assert.Equal(t, reasonOptedOut, server.filter(line("nginx", map[string]string{AnnotationExclude: "true"})))
+	assert.Equal(t, reasonOptedOut, server.filter(line("nginx", map[string]string{AnnotationExclude: "True"})))
+	assert.Equal(t, reasonOptedOut, server.filter(line("nginx", map[string]string{AnnotationExclude: "1"})))
+	assert.Equal(t, "", server.filter(line("nginx", map[string]string{AnnotationExclude: "false"})))
+	assert.Equal(t, "", server.filter(line("nginx", map[string]string{AnnotationExclude: "yes please"})))
+	assert.Equal(t, reasonOptedOut, server.filter(line("istio-proxy", map[string]string{AnnotationExcludeContainers: "linkerd-proxy, istio-proxy"})))
+	assert.Equal(t, "", server.filter(line("nginx", map[string]string{AnnotationExcludeContainers: "linkerd-proxy, istio-proxy"})))
+	assert.Equal(t, reasonSampled, server.filter(line("nginx", map[string]string{AnnotationSampleRate: "0"})))
+	assert.Equal(t, "", server.filter(line("nginx", map[string]string{AnnotationSampleRate: "1"})))
+
+	// Invalid sample rates keep all lines.
+	assert.Equal(t, "", server.filter(line("nginx", map[string]string{AnnotationSampleRate: "ten percent"})))
+}
+
+func TestDestinationsSkipped(t *testing.T) {
+	server := &Server{
+		Namespaces: mockNamespaces{
+			"default": {
+				AnnotationExclude: "true",
+			},
+		},
+	}
+
+	// Annotations inherited from the Namespace are applied too.
+	_, destinations, err := server.Destinations(fluentbit.Line{
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "default",
+		},
+	})
+	assert.ErrorIs(t, err, ErrSkipped)
+	assert.ErrorContains(t, err, reasonOptedOut)
+	assert.Empty(t, destinations)
+}
+
+func TestSampled(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var kept int
+
+	// Lines logged across many windows.
+	for i := 0; i < 10000; i++ {
+		line := fluentbit.Line{
+			Timestamp: start.Add(time.Duration(i) * sampleWindow),
+			Log:       fmt.Sprintf("line %d", i),
+			Kubernetes: fluentbit.Kubernetes{
+				Pod:       "web",
+				Container: "nginx",
+			},
+		}
+
+		keep := sampled(line, 0.1)
+		if keep {
+			kept++
+		}
+
+		// The same line always gets the same decision.
+		assert.Equal(t, keep, sampled(line, 0.1))
+	}
+
+	assert.InDelta(t, 1000, kept, 150)
+}
+
+func TestSampledTrace(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	trace := []string{
+		"panic: runtime error: invalid memory address or nil pointer dereference",
+		"goroutine 1 [running]:",
+		"main.main()",
+		"\t/app/main.go:12 +0x1d",
+	}
+
+	for i := 0; i < 100; i++ {
+		var decisions []bool
+
+		// Consecutive lines of a trace which Fluent Bit has not joined together.
+		for j, message := range trace {
+			decisions = append(decisions, sampled(fluentbit.Line{
+				Timestamp: start.Add(time.Duration(i)*sampleWindow + time.Duration(j)*time.Millisecond),
+				Log:       message,
+				Kubernetes: fluentbit.Kubernetes{
+					Pod:       "web",
+					Container: "app",
+				},
+			}, 0.5))
+		}
+
+		for _, keep := range decisions {
+			assert.Equal(t, decisions[0], keep)
+		}
+	}
+}
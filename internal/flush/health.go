@@ -0,0 +1,77 @@
+package flush
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Activity of flushes and background loops, used to detect a wedged process.
+type activity struct {
+	lock sync.Mutex
+	// Identifier for the next flush.
+	next uint64
+	// When each flush which is being handled started.
+	flushes map[uint64]time.Time
+	// When each background loop last completed an iteration.
+	loops map[string]time.Time
+}
+
+// Helper function to track a flush, returns a function which is called when it has finished.
+func (a *activity) start() func() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.flushes == nil {
+		a.flushes = make(map[uint64]time.Time)
+	}
+
+	id := a.next
+	a.next++
+
+	a.flushes[id] = time.Now()
+
+	return func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		delete(a.flushes, id)
+	}
+}
+
+// Helper function to record that a background loop has completed an iteration.
+func (a *activity) beat(loop string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.loops == nil {
+		a.loops = make(map[string]time.Time)
+	}
+
+	a.loops[loop] = time.Now()
+}
+
+// Healthy returns an error if a flush or background loop has not made progress within the threshold.
+//
+// Flushes are abandoned after the flush timeout, so a flush which runs for longer than
+// that is stuck, for example behind a call which does not respect its context.
+func (s *Server) Healthy(threshold time.Duration) error {
+	s.activity.lock.Lock()
+	defer s.activity.lock.Unlock()
+
+	now := time.Now()
+
+	for _, started := range s.activity.flushes {
+		if age := now.Sub(started); age > threshold {
+			return fmt.Errorf("flush has been running for %s", age.Round(time.Second))
+		}
+	}
+
+	for loop, beat := range s.activity.loops {
+		if age := now.Sub(beat); age > threshold {
+			return fmt.Errorf("%s loop has not made progress for %s", loop, age.Round(time.Second))
+		}
+	}
+
+	return nil
+}
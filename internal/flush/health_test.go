@@ -0,0 +1,27 @@
+package flush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthy(t *testing.T) {
+	server := &Server{}
+
+	done := server.activity.start()
+	assert.Nil(t, server.Healthy(time.Minute))
+
+	// A flush which has been running for longer than the threshold is stuck.
+	server.activity.flushes[0] = time.Now().Add(-2 * time.Minute)
+	assert.NotNil(t, server.Healthy(time.Minute))
+
+	done()
+	assert.Nil(t, server.Healthy(time.Minute))
+
+	// A background loop which has stopped making progress.
+	server.activity.beat("buffer")
+	server.activity.loops["buffer"] = time.Now().Add(-2 * time.Minute)
+	assert.NotNil(t, server.Healthy(time.Minute))
+}
@@ -0,0 +1,31 @@
+package flush
+
+import (
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+var (
+	recordsReceived = metrics.NewCounter("records_received_total", "Records received from Fluent Bit.")
+	recordsRouted   = metrics.NewCounter("records_routed_total", "Records routed to a log group, by group.", "group")
+	recordsSkipped  = metrics.NewCounter("records_skipped_total", "Records which will not be pushed to CloudWatch Logs, by reason.", "reason")
+	inFlight        = metrics.NewGauge("requests_in_flight", "Flushes which are being handled.")
+)
+
+// Reason which is recorded when a routing rule drops a record.
+const reasonDropped = "dropped"
+
+// Decoder which counts the records it has received.
+type countingDecoder struct {
+	fluentbit.Decoder
+}
+
+// Next record, counting it if it was decoded.
+func (d countingDecoder) Next() (fluentbit.Line, error) {
+	line, err := d.Decoder.Next()
+	if err == nil {
+		recordsReceived.Inc()
+	}
+
+	return line, err
+}
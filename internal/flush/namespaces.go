@@ -0,0 +1,70 @@
+package flush
+
+import (
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Namespaces which Pods inherit annotations from.
+type Namespaces interface {
+	// Annotations for a Namespace.
+	Annotations(namespace string) map[string]string
+}
+
+// Annotations which name the group and stream of a line.
+var namingAnnotations = []string{
+	AnnotationProject,
+	AnnotationEnvironment,
+	AnnotationGroupOverride,
+	AnnotationStreamOverride,
+}
+
+// Overrides which would take precedence over the naming annotations of a Pod.
+var overrideAnnotations = map[string]bool{
+	AnnotationGroupOverride:  true,
+	AnnotationStreamOverride: true,
+}
+
+// Helper function to add annotations from the Namespace of a line, Pod annotations take precedence.
+// Overrides are only inherited by Pods which don't name their lines, otherwise a Namespace
+// override would take precedence over the project and environment of the Pod.
+func (s *Server) inherit(line fluentbit.Line) fluentbit.Line {
+	if s.Namespaces == nil {
+		return line
+	}
+
+	inherited := s.Namespaces.Annotations(line.Kubernetes.Namespace)
+	if len(inherited) == 0 {
+		return line
+	}
+
+	annotations := make(map[string]string, len(inherited)+len(line.Kubernetes.Annotations))
+
+	named := names(line.Kubernetes.Annotations)
+
+	for key, value := range inherited {
+		if named && overrideAnnotations[key] {
+			continue
+		}
+
+		annotations[key] = value
+	}
+
+	for key, value := range line.Kubernetes.Annotations {
+		annotations[key] = value
+	}
+
+	line.Kubernetes.Annotations = annotations
+
+	return line
+}
+
+// Helper function to check if annotations contain any of the naming annotations.
+func names(annotations map[string]string) bool {
+	for _, key := range namingAnnotations {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
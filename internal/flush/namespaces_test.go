@@ -0,0 +1,81 @@
+package flush
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Namespaces with static annotations.
+type mockNamespaces map[string]map[string]string
+
+func (m mockNamespaces) Annotations(namespace string) map[string]string {
+	return m[namespace]
+}
+
+func TestInherit(t *testing.T) {
+	server := &Server{
+		Prefix:  "prefix",
+		Cluster: "example",
+		Namespaces: mockNamespaces{
+			"default": {
+				AnnotationProject:     "foo",
+				AnnotationEnvironment: "dev",
+			},
+		},
+	}
+
+	// Pods inherit annotations which they don't set.
+	_, destinations, err := server.Destinations(fluentbit.Line{
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "default",
+			Container: "nginx",
+			Annotations: map[string]string{
+				AnnotationEnvironment: "prod",
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Destination{{Group: "/prefix/example/foo/prod", Stream: "nginx"}}, destinations)
+
+	// Overrides aren't inherited by Pods which name their lines.
+	server.Namespaces = mockNamespaces{
+		"default": {
+			AnnotationGroupOverride:  "shared",
+			AnnotationStreamOverride: "shared",
+		},
+	}
+
+	_, destinations, err = server.Destinations(fluentbit.Line{
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "default",
+			Container: "nginx",
+			Annotations: map[string]string{
+				AnnotationProject:     "bar",
+				AnnotationEnvironment: "prod",
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Destination{{Group: "/prefix/example/bar/prod", Stream: "nginx"}}, destinations)
+
+	// Pods which don't name their lines still inherit overrides.
+	_, destinations, err = server.Destinations(fluentbit.Line{
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "default",
+			Container: "nginx",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Destination{{Group: "shared", Stream: "shared"}}, destinations)
+
+	// Pods in other namespaces are unchanged.
+	_, _, err = server.Destinations(fluentbit.Line{
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "other",
+		},
+	})
+	assert.ErrorContains(t, err, "not found: "+AnnotationProject)
+}
@@ -2,118 +2,554 @@ package flush
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"slices"
 	"sync"
-
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"time"
 
 	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/buffer"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
 	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/routing"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/wal"
+	// Register the msgpack format.
+	_ "github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/msgpack"
 )
 
 const (
+	// AnnotationPrefix is shared by all annotations which are used by this process.
+	AnnotationPrefix = "fluentbit.skpr.io/"
 	// AnnotationProject is used to construct a CloudWatch Logs group.
 	AnnotationProject = "fluentbit.skpr.io/project"
 	// AnnotationEnvironment is used to construct a CloudWatch Logs group.
 	AnnotationEnvironment = "fluentbit.skpr.io/environment"
 	// AnnotationGroupOverride is used for overriding the default project/environment naming convention.
 	AnnotationGroupOverride = "fluentbit.skpr.io/group-override"
+	// AnnotationStreamOverride is used for overriding the stream template.
+	AnnotationStreamOverride = "fluentbit.skpr.io/stream-override"
+	// AnnotationExclude drops all lines from a Pod when set to true eg. "true", "True" or "1".
+	AnnotationExclude = "fluentbit.skpr.io/exclude"
+	// AnnotationExcludeContainers drops lines from a comma separated list of containers eg. istio-proxy
+	AnnotationExcludeContainers = "fluentbit.skpr.io/exclude-containers"
+	// AnnotationSampleRate keeps a fraction of lines between 0 and 1 eg. 0.1 keeps 10%
+	AnnotationSampleRate = "fluentbit.skpr.io/sample-rate"
 )
 
+// DefaultGroupTemplate names groups /prefix/cluster/project/environment using the project and environment annotations.
+const DefaultGroupTemplate = `/{{ .Prefix }}/{{ .Cluster }}/{{ .Annotation "` + AnnotationProject + `" }}/{{ .Annotation "` + AnnotationEnvironment + `" }}`
+
+// DefaultStreamTemplate names streams after the container.
+const DefaultStreamTemplate = `{{ .Container }}`
+
 // Server for handling flush requests.
 type Server struct {
 	// Client for interacting with CloudWatch Logs.
-	Client *cloudwatchlogs.Client
+	Client logger.API
 	// Prefix to apply to CloudWatch Logs groups.
 	Prefix string
 	// Cluster which this process resides.
 	Cluster string
-	// Lock to ensure we only have one process pushing logs.
-	lock sync.Mutex
+	// Template for naming log groups. Defaults to DefaultGroupTemplate.
+	GroupTemplate *naming.Template
+	// Template for naming log streams. Defaults to DefaultStreamTemplate.
+	StreamTemplate *naming.Template
+	// Rules which are evaluated before the group and stream templates.
+	Routes *routing.Rules
+	// Group for lines which cannot be named by the group template. Lines are not routed when nil.
+	Fallback *Fallback
+	// Annotations which Pods inherit from their Namespace when they don't set them.
+	Namespaces Namespaces
+	// Buffer events in memory and push them in the background instead of during the flush.
+	Async bool
+	// Maximum amount of events buffered for a single stream in async mode.
+	BufferStreamSize int
+	// Maximum amount of events buffered across all streams in async mode.
+	BufferSize int
+	// Amount of events buffered for a stream which triggers a push in async mode.
+	BufferFlushSize int
+	// Maximum time events are buffered before they are pushed in async mode.
+	BufferFlushInterval time.Duration
+	// Write-ahead log which lines are appended to before they are acked.
+	WAL *wal.Log
+	// Amount of lines which are read from the write-ahead log and pushed at a time.
+	WALBatchSize int
+	// How long log groups and streams are cached before they are created again.
+	CacheTTL time.Duration
+	// Amount of streams which will be pushed in parallel, shared by all flushes.
+	Concurrency int
+	// Cache of log groups and streams which are known to exist, shared by all flushes.
+	cache *logger.Cache
+	// Locks to ensure only one flush is pushing to a stream at a time. If we don't do
+	// this there is a chance that flushes could compete with each other if they are
+	// pushing to the same stream.
+	locks *dispatcher.StreamLocks
+	// Limits the amount of streams pushed in parallel across all flushes.
+	limiter *dispatcher.Limiter
+	// Buffer of events waiting to be pushed in async mode.
+	buffer *buffer.Buffer
+	// Ensures state shared by all flushes is only initialised once.
+	once sync.Once
+	// Activity of flushes and background loops, used to check the process is healthy.
+	activity activity
+	// Closed to stop background loops when the server is shut down.
+	stop chan struct{}
+	// Background loops which are running.
+	loops sync.WaitGroup
 	// Amount of events to keep before flushing.
 	BatchSize int
+	// Policy for messages which exceed the CloudWatch Logs event size limit.
+	Oversize dispatcher.OversizePolicy
+	// Policy for events which are outside of the window CloudWatch Logs accepts.
+	Time dispatcher.TimePolicy
+	// Oldest event which will be pushed.
+	MaxAge time.Duration
+	// Furthest in the future an event which will be pushed can be.
+	MaxFuture time.Duration
+	// Retry configuration for pushing events.
+	Retry logger.Retry
+	// Maximum time a flush can take before it is abandoned. Unlimited when zero.
+	FlushTimeout time.Duration
+	// Maximum size of a request body once it has been decompressed. Unlimited when zero.
+	MaxBodySize int64
+	// Format which Fluent Bit ships with. Detected from the Content-Type header when empty.
+	Format string
+	// Sink for lines which could not be delivered. Lines are only logged when nil.
+	DeadLetter deadletter.Sink
 	// Toggles on debugging.
 	Debug bool
 }
 
+// ErrDecode is returned when lines could not be decoded from a payload.
+var ErrDecode = errors.New("failed to decode")
+
+// Handler which only accepts flush requests on a path.
+//
+// Requests for other paths are not found and requests with a method other than POST are not allowed.
+func (s *Server) Handler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.ServeHTTP(w, r)
+	})
+}
+
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// This ensures that we are only processing a single request at a time.
-	// If we don't do this there is a chance that requests could compete with
-	// each other if they are pushing to the same stream.
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	log.Println("Parsing new request")
 
-	lines, err := json.Parse(r.Body)
+	format, err := s.format(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		log.Println("Failed to determine format:", err)
+		return
+	}
+
+	body, err := decompress(r.Header.Get("Content-Encoding"), r.Body, s.MaxBodySize)
+	if errors.Is(err, ErrUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		log.Println("Failed to decompress request:", err)
+		return
+	}
+
+	if errors.Is(err, ErrBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		log.Println("Failed to decompress request:", err)
+		return
+	}
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("Failed to decompress request:", err)
+		return
+	}
+
+	defer body.Close()
+
+	// Pushes are cancelled when Fluent Bit disconnects, it will retry the request.
+	err = s.Flush(r.Context(), format.NewDecoder(body))
+	if errors.Is(err, buffer.ErrFull) {
+		// Push back so Fluent Bit retries the request using its own buffering.
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		log.Println("Failed to buffer request:", err)
+		return
+	}
+
+	if errors.Is(err, ErrBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 		log.Println("Failed to parse request:", err)
 		return
 	}
 
-	log.Println("Initialising dispatcher client")
+	if errors.Is(err, ErrDecode) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Println("Failed to parse request:", err)
+		return
+	}
 
-	client, err := dispatcher.New(s.Client, s.BatchSize, s.Debug)
+	// Fluent Bit resends the whole request, including streams which were sent.
+	// This only happens without a dead-letter sink, see Server.failed.
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("Failed to setup dispatcher:", err)
+		log.Println("Failed to send logs:", err)
 		return
 	}
+}
+
+// Flush lines from a decoder to CloudWatch Logs.
+//
+// In async mode lines are added to the buffer and pushed in the background.
+// When a write-ahead log is configured lines are appended to it and pushed in the background.
+func (s *Server) Flush(ctx context.Context, decoder fluentbit.Decoder) error {
+	s.once.Do(s.init)
+
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+
+	defer s.activity.start()()
+
+	decoder = countingDecoder{decoder}
+
+	if s.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FlushTimeout)
+		defer cancel()
+	}
+
+	if s.WAL != nil {
+		return s.appendWAL(decoder)
+	}
+
+	log.Println("Initialising dispatcher client")
+
+	client, err := s.batch()
+	if err != nil {
+		return fmt.Errorf("failed to setup dispatcher: %w", err)
+	}
+
+	err = s.route(client, decoder)
+	if err != nil {
+		return errors.Join(err, client.deadLetter(ctx))
+	}
+
+	if s.buffer != nil {
+		err = s.buffer.Add(client.Groups)
+		return errors.Join(err, client.deadLetter(ctx))
+	}
+
+	err = s.failed(ctx, client, client.Client.Send(ctx))
+
+	// Lines are still dead-lettered when the flush has timed out. If they can't be, the
+	// flush fails so Fluent Bit retries it instead of the lines being lost.
+	return errors.Join(err, client.deadLetter(context.WithoutCancel(ctx)))
+}
+
+// Helper function to dead-letter the streams of a batch which failed to send.
+//
+// Fluent Bit retries a failed flush in full, which would push the streams which were sent
+// again. When there is a dead-letter sink, streams which failed with an error that would
+// fail again are dead-lettered instead. Streams which failed with a transient error are
+// returned as a SendError so Fluent Bit retries the flush, as are flushes which were
+// cancelled or timed out.
+func (s *Server) failed(ctx context.Context, client *Batch, err error) error {
+	var sendErr *dispatcher.SendError
+	if s.DeadLetter == nil || ctx.Err() != nil || !errors.As(err, &sendErr) {
+		return err
+	}
+
+	var retry []dispatcher.StreamError
+
+	for _, failed := range sendErr.Failed {
+		if logger.Retryable(failed.Err) {
+			retry = append(retry, failed)
+			continue
+		}
+
+		log.Printf("Dead-lettering %s/%s which failed to send: %s\n", failed.Group, failed.Stream, failed.Err)
+
+		lines := client.Groups[failed.Group][failed.Stream]
+
+		client.skip(deadletter.ReasonUndeliverable, len(lines))
+		client.add(undeliverable(failed.Group, failed.Stream, lines, deadletter.ReasonUndeliverable, failed.Err)...)
+	}
+
+	if len(retry) > 0 {
+		return &dispatcher.SendError{Failed: retry}
+	}
+
+	return nil
+}
+
+// Route lines from a decoder to their log group and stream without pushing them.
+// The returned batch can be used to push the lines. Lines which cannot be routed are dead-lettered.
+func (s *Server) Route(decoder fluentbit.Decoder) (*Batch, error) {
+	s.once.Do(s.init)
+
+	client, err := s.batch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup dispatcher: %w", err)
+	}
+
+	err = s.route(client, decoder)
+
+	return client, errors.Join(err, client.deadLetter(context.TODO()))
+}
+
+// Helper function to route lines from a decoder to their log group and stream.
+// Lines which cannot be routed are added to the batch to be dead-lettered.
+func (s *Server) route(client *Batch, decoder fluentbit.Decoder) error {
+	for {
+		line, err := decoder.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrDecode, err)
+		}
+
+		line = s.inherit(line)
+
+		if reason := s.filter(line); reason != "" {
+			if s.Debug {
+				log.Printf("skipping %s/%s because it was %s\n", line.Kubernetes.Namespace, line.Kubernetes.Pod, reason)
+			}
 
-	for _, line := range lines {
-		group, err := groupName(s.Prefix, s.Cluster, line.Kubernetes.Annotations)
+			client.skip(reason, 1)
+
+			continue
+		}
+
+		result, destinations, err := s.destinations(line)
 		if err != nil {
 			if s.Debug {
 				log.Printf("skipping %s/%s because: %s\n", line.Kubernetes.Namespace, line.Kubernetes.Pod, err)
 			}
 
+			client.skip(deadletter.ReasonUnrouted, 1)
+
+			client.add(deadletter.Record{
+				Timestamp:  line.Timestamp,
+				Log:        line.Log,
+				Kubernetes: line.Kubernetes,
+				Reason:     deadletter.ReasonUnrouted,
+				Error:      err.Error(),
+			})
+
 			continue
 		}
 
-		err = client.Add(group, line.Kubernetes.Container, line.Timestamp, line.Log)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Println("Failed to add log to dispatcher:", err)
-			return
+		if len(destinations) == 0 {
+			reason := reasonDropped
+			if !result.Drop {
+				reason = reasonExcluded
+			}
+
+			if s.Debug {
+				log.Printf("skipping %s/%s because it was %s\n", line.Kubernetes.Namespace, line.Kubernetes.Pod, reason)
+			}
+
+			client.skip(reason, 1)
+
+			continue
+		}
+
+		for _, destination := range destinations {
+			err = client.Add(destination.Group, destination.Stream, line)
+			if err != nil {
+				return fmt.Errorf("failed to add log to dispatcher: %w", err)
+			}
+
+			recordsRouted.Inc(destination.Group)
 		}
 	}
+}
 
-	err = client.Send(context.TODO())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("Failed to send logs:", err)
-		return
+// Helper function to create a batch for a single flush.
+func (s *Server) batch() (*Batch, error) {
+	b := &Batch{server: s}
+
+	var err error
+
+	b.Client, err = dispatcher.New(s.Client, dispatcher.Config{
+		BatchSize:   s.BatchSize,
+		Oversize:    s.Oversize,
+		Time:        s.Time,
+		MaxAge:      s.MaxAge,
+		MaxFuture:   s.MaxFuture,
+		Retry:       s.Retry,
+		Cache:       s.cache,
+		Locks:       s.locks,
+		Limiter:     s.limiter,
+		Concurrency: s.Concurrency,
+		Rejected:    b.rejected,
+		Debug:       s.Debug,
+	})
+
+	return b, err
+}
+
+// Helper function to initialise state which is shared by all flushes.
+func (s *Server) init() {
+	if s.CacheTTL > 0 {
+		s.cache = logger.NewCache(s.CacheTTL)
+	}
+
+	s.locks = dispatcher.NewStreamLocks()
+	s.limiter = dispatcher.NewLimiter(s.Concurrency)
+
+	if s.GroupTemplate == nil {
+		s.GroupTemplate = naming.MustParse("group", DefaultGroupTemplate)
+	}
+
+	if s.StreamTemplate == nil {
+		s.StreamTemplate = naming.MustParse("stream", DefaultStreamTemplate)
+	}
+
+	s.stop = make(chan struct{})
+
+	if s.WAL != nil {
+		s.loops.Add(1)
+		go s.sendWAL()
+	} else if s.Async {
+		s.buffer = buffer.New(s.BufferStreamSize, s.BufferSize)
+		s.loops.Add(1)
+		go s.background()
 	}
 }
 
-// Helper function to get the value from a Kubernetes resource annotation.
-func getAnnotationValue(annotations map[string]string, key string) (string, error) {
-	if _, ok := annotations[key]; !ok {
-		return "", fmt.Errorf("not found: %s", key)
+// Helper function to determine the format of a request.
+func (s *Server) format(contentType string) (fluentbit.Format, error) {
+	if s.Format != "" {
+		return fluentbit.Lookup(s.Format)
+	}
+
+	if contentType == "" {
+		return fluentbit.Lookup(json.Format)
 	}
 
-	return annotations[key], nil
+	return fluentbit.LookupContentType(contentType)
+}
+
+// Helper function to return the data available to naming templates for a line.
+func (s *Server) data(line fluentbit.Line) naming.Data {
+	return naming.Data{
+		Prefix:      s.Prefix,
+		Cluster:     s.Cluster,
+		Namespace:   line.Kubernetes.Namespace,
+		Pod:         line.Kubernetes.Pod,
+		Container:   line.Kubernetes.Container,
+		Node:        line.Kubernetes.Host,
+		Labels:      line.Kubernetes.Labels,
+		Annotations: line.Kubernetes.Annotations,
+		Time:        line.Timestamp,
+	}
+}
+
+// Destination which a line is pushed to.
+type Destination struct {
+	Group  string
+	Stream string
+}
+
+// Destinations evaluates the routing rules for a line and returns the groups and streams it
+// would be pushed to. A line which is dropped or excluded from the fallback group has no destinations.
+// Lines which are skipped because of the Pod's annotations return ErrSkipped along with the reason.
+func (s *Server) Destinations(line fluentbit.Line) (routing.Result, []Destination, error) {
+	s.once.Do(s.init)
+
+	line = s.inherit(line)
+
+	if reason := s.filter(line); reason != "" {
+		return routing.Result{}, nil, fmt.Errorf("%w: %s", ErrSkipped, reason)
+	}
+
+	return s.destinations(line)
+}
+
+// Helper function to determine the groups and streams for a line.
+// The line cannot be routed if any of its destinations fail to be named.
+func (s *Server) destinations(line fluentbit.Line) (routing.Result, []Destination, error) {
+	var (
+		result       = s.Routes.Evaluate(line)
+		data         = s.data(line)
+		destinations []Destination
+	)
+
+	for _, target := range result.Targets {
+		var (
+			group, stream string
+			err           error
+		)
+
+		// Targets which don't set a template use the defaults, including their override annotations.
+		if target.Group != nil {
+			group, err = target.Group.Execute(data)
+		} else {
+			group, err = s.groupName(data)
+		}
+
+		// Other destinations still receive lines which are excluded from the fallback group.
+		if errors.Is(err, errExcluded) {
+			continue
+		}
+
+		if err != nil {
+			return result, nil, err
+		}
+
+		if target.Stream != nil {
+			stream, err = target.Stream.Execute(data)
+		} else {
+			stream, err = streamName(s.StreamTemplate, data)
+		}
+
+		if err != nil {
+			return result, nil, err
+		}
+
+		destination := Destination{Group: group, Stream: stream}
+
+		// Rules which continue could route a line to the same destination more than once.
+		if !slices.Contains(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+
+	return result, destinations, nil
 }
 
 // Helper function to determine the group name for a Pod.
-func groupName(prefix, cluster string, annotations map[string]string) (string, error) {
-	if override, ok := annotations[AnnotationGroupOverride]; ok {
+func groupName(tmpl *naming.Template, data naming.Data) (string, error) {
+	if override, ok := data.Annotations[AnnotationGroupOverride]; ok {
 		return override, nil
 	}
 
-	project, err := getAnnotationValue(annotations, AnnotationProject)
-	if err != nil {
-		return "", err
-	}
+	return tmpl.Execute(data)
+}
 
-	environment, err := getAnnotationValue(annotations, AnnotationEnvironment)
-	if err != nil {
-		return "", err
+// Helper function to determine the stream name for a Pod.
+func streamName(tmpl *naming.Template, data naming.Data) (string, error) {
+	if override, ok := data.Annotations[AnnotationStreamOverride]; ok {
+		return override, nil
 	}
 
-	return fmt.Sprintf("/%s/%s/%s/%s", prefix, cluster, project, environment), nil
+	return tmpl.Execute(data)
 }
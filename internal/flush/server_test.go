@@ -1,24 +1,295 @@
 package flush
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter/deadlettertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/routing"
 )
 
+// Mock sink which records the dead-lettered records.
 func TestGroupName(t *testing.T) {
+	tmpl := naming.MustParse("group", DefaultGroupTemplate)
+
 	// Test an override.
-	actual, err := groupName("prefix", "example", map[string]string{
-		AnnotationGroupOverride: "/skpr/example/foo/bar",
+	actual, err := groupName(tmpl, naming.Data{
+		Prefix:  "prefix",
+		Cluster: "example",
+		Annotations: map[string]string{
+			AnnotationGroupOverride: "/skpr/example/foo/bar",
+		},
 	})
 	assert.Nil(t, err)
 	assert.Equal(t, "/skpr/example/foo/bar", actual)
 
 	// Test a generated group name.
-	actual, err = groupName("prefix", "example", map[string]string{
-		AnnotationProject:     "project",
-		AnnotationEnvironment: "environment",
+	actual, err = groupName(tmpl, naming.Data{
+		Prefix:  "prefix",
+		Cluster: "example",
+		Annotations: map[string]string{
+			AnnotationProject:     "project",
+			AnnotationEnvironment: "environment",
+		},
 	})
 	assert.Nil(t, err)
 	assert.Equal(t, "/prefix/example/project/environment", actual)
+
+	// Test a missing annotation.
+	_, err = groupName(tmpl, naming.Data{
+		Annotations: map[string]string{
+			AnnotationProject: "project",
+		},
+	})
+	assert.EqualError(t, err, "not found: "+AnnotationEnvironment)
+}
+
+func TestGroupNameTemplate(t *testing.T) {
+	tmpl := naming.MustParse("group", `/{{ .Cluster }}/{{ .Namespace | lower | sanitize }}`)
+
+	actual, err := groupName(tmpl, naming.Data{
+		Cluster:   "example",
+		Namespace: "Team:A",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/example/team-a", actual)
+}
+
+func TestRouteDeadLetter(t *testing.T) {
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Prefix:     "prefix",
+		Cluster:    "example",
+		DeadLetter: sink,
+	}
+
+	decoder := json.NewStreamDecoder(strings.NewReader(`{"log":"foo","kubernetes":{"namespace_name":"default","pod_name":"web"}}`))
+
+	_, err := server.Route(decoder)
+	assert.Nil(t, err)
+
+	// Lines without annotations cannot be routed to a group.
+	assert.Len(t, sink.Records, 1)
+	assert.Equal(t, "foo", sink.Records[0].Log)
+	assert.Equal(t, "web", sink.Records[0].Kubernetes.Pod)
+	assert.Equal(t, deadletter.ReasonUnrouted, sink.Records[0].Reason)
+	assert.False(t, sink.Records[0].DeadLettered.IsZero())
+}
+
+func TestRouteRules(t *testing.T) {
+	routes, err := routing.Parse([]byte(`
+rules:
+  - match:
+      message: healthz
+    drop: true
+  - match:
+      namespace: default
+    destinations:
+      - group: /{{ .Namespace }}
+      - group: /{{ .Namespace }}
+        stream: "{{ .Pod }}"
+`))
+	assert.Nil(t, err)
+
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Prefix:     "prefix",
+		Cluster:    "example",
+		Routes:     routes,
+		DeadLetter: sink,
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	decoder := json.NewStreamDecoder(strings.NewReader(`
+{"timestamp":"` + now + `","log":"GET /healthz","kubernetes":{"namespace_name":"default","pod_name":"web","container_name":"nginx"}}
+{"timestamp":"` + now + `","log":"foo","kubernetes":{"namespace_name":"default","pod_name":"web","container_name":"nginx"}}
+`))
+
+	client, err := server.Route(decoder)
+	assert.Nil(t, err)
+
+	// Dropped lines are not dead-lettered.
+	assert.Empty(t, sink.Records)
+
+	assert.Len(t, client.Groups, 1)
+	assert.Len(t, client.Groups["/default"], 2)
+	assert.Len(t, client.Groups["/default"]["nginx"], 1)
+	assert.Len(t, client.Groups["/default"]["web"], 1)
+}
+
+func TestStreamName(t *testing.T) {
+	tmpl := naming.MustParse("stream", `{{ .Node }}/{{ .Pod }}/{{ .Container }}/{{ .Date }}`)
+
+	// Test an override.
+	actual, err := streamName(tmpl, naming.Data{
+		Annotations: map[string]string{
+			AnnotationStreamOverride: "custom",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "custom", actual)
+
+	// Test a generated stream name.
+	actual, err = streamName(tmpl, naming.Data{
+		Node:      "node-1",
+		Pod:       "web-abc123",
+		Container: "nginx",
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1/web-abc123/nginx/2024-01-02", actual)
+}
+
+func TestHandler(t *testing.T) {
+	handler := (&Server{}).Handler("/flush")
+
+	// Other paths are not routed.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/pprof/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Only flush requests are allowed.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/flush", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+}
+
+func TestServeHTTPJSONLines(t *testing.T) {
+	api := &loggertest.API{}
+
+	server := &Server{
+		Client:    api,
+		BatchSize: 10,
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	// Fluent Bit sends application/json for the json_lines format.
+	body := `{"timestamp":"` + now + `","log":"foo","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}
+{"timestamp":"` + now + `","log":"bar","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}
+`
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"foo", "bar"}, api.Messages())
+}
+
+func TestFlushDeadLettersOnce(t *testing.T) {
+	api := &loggertest.API{}
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Client:     api,
+		BatchSize:  10,
+		Time:       dispatcher.TimeDeadLetter,
+		DeadLetter: sink,
+	}
+
+	// Lines which are too old to push.
+	body := strings.Repeat(`{"timestamp":"2000-01-01T00:00:00Z","log":"foo","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}
+`, 5)
+
+	assert.Nil(t, server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(body))))
+	assert.Empty(t, api.Messages())
+	assert.Len(t, sink.Records, 5)
+	assert.Equal(t, 1, sink.Writes)
+}
+
+// API which fails to push to a group.
+func TestFlushFailedStreams(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+
+	body := `{"timestamp":"` + now + `","log":"foo","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"good"}}}
+{"timestamp":"` + now + `","log":"bar","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"bad"}}}
+`
+
+	// Without a dead-letter sink the flush fails so Fluent Bit retries it.
+	api := &loggertest.API{Errors: map[string]error{"bad": &types.InvalidParameterException{}}}
+
+	server := &Server{
+		Client:    api,
+		BatchSize: 10,
+	}
+
+	var sendErr *dispatcher.SendError
+
+	err := server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(body)))
+	assert.ErrorAs(t, err, &sendErr)
+	assert.Equal(t, []string{"foo"}, api.Messages())
+
+	// With a dead-letter sink the failed stream is dead-lettered and the flush succeeds,
+	// so the stream which was sent isn't pushed again.
+	api = &loggertest.API{Errors: map[string]error{"bad": &types.InvalidParameterException{}}}
+	sink := &deadlettertest.Sink{}
+
+	server = &Server{
+		Client:     api,
+		BatchSize:  10,
+		DeadLetter: sink,
+	}
+
+	assert.Nil(t, server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(body))))
+	assert.Equal(t, []string{"foo"}, api.Messages())
+	assert.Len(t, sink.Records, 1)
+	assert.Equal(t, "bar", sink.Records[0].Log)
+	assert.Equal(t, deadletter.ReasonUndeliverable, sink.Records[0].Reason)
+
+	// Streams which failed with a transient error aren't dead-lettered, the flush fails so
+	// Fluent Bit retries it.
+	api = &loggertest.API{Errors: map[string]error{"bad": &types.ServiceUnavailableException{}}}
+	sink = &deadlettertest.Sink{}
+
+	server = &Server{
+		Client:     api,
+		BatchSize:  10,
+		DeadLetter: sink,
+	}
+
+	err = server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(body)))
+	assert.ErrorAs(t, err, &sendErr)
+	assert.Len(t, sendErr.Failed, 1)
+	assert.Equal(t, "bad", sendErr.Failed[0].Group)
+	assert.Empty(t, sink.Records)
+}
+
+func TestFlushDeadLetterError(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+
+	body := `{"timestamp":"` + now + `","log":"bar","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"bad"}}}
+`
+
+	// The flush fails when the failed stream can't be dead-lettered, so the lines aren't lost.
+	sink := &deadlettertest.Sink{Err: errors.New("sink unavailable")}
+
+	server := &Server{
+		Client:     &loggertest.API{Errors: map[string]error{"bad": &types.InvalidParameterException{}}},
+		BatchSize:  10,
+		DeadLetter: sink,
+	}
+
+	err := server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(body)))
+	assert.ErrorIs(t, err, sink.Err)
+	assert.Equal(t, 1, sink.Writes)
 }
@@ -0,0 +1,179 @@
+package flush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+)
+
+// Share of the shutdown grace period for waiting on background pushes, the rest is for draining the buffer.
+const shutdownLoopsShare = 0.5
+
+// Shutdown stops pushing in the background and drains lines which are pending.
+//
+// Lines buffered in async mode are pushed until the context is done. Lines which could
+// not be pushed are abandoned and dead-lettered. Lines in the write-ahead log stay
+// spooled on disk and are pushed when the process starts again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(s.init)
+
+	// Cancels pushes which are in progress.
+	close(s.stop)
+
+	// Wait for a push which is in progress so its lines are requeued instead of pushed twice.
+	// The rest of the time is left for draining the buffer.
+	loopsCtx, cancel := share(ctx, shutdownLoopsShare)
+	defer cancel()
+
+	err := wait(loopsCtx, &s.loops)
+	if err != nil {
+		err = fmt.Errorf("background push did not finish: %w", err)
+	}
+
+	if s.buffer != nil {
+		flushed, abandoned := s.drain(ctx, s.buffer.Drain())
+
+		// Lines requeued by a push which finished late would otherwise be lost.
+		abandoned += s.abandon(ctx, s.buffer.Drain(), errors.New("requeued after draining"))
+
+		log.Printf("Shutdown flushed %d buffered lines and abandoned %d\n", flushed, abandoned)
+	}
+
+	if s.WAL != nil {
+		log.Printf("Shutdown left %d bytes spooled in the write-ahead log\n", s.WAL.Pending())
+		err = errors.Join(err, s.WAL.Close())
+	}
+
+	return err
+}
+
+// Helper function to push lines, returning the amount of lines which were flushed and abandoned.
+func (s *Server) drain(ctx context.Context, groups map[string]dispatcher.Streams) (int, int) {
+	var total int
+
+	for _, streams := range groups {
+		for _, lines := range streams {
+			total += len(lines)
+		}
+	}
+
+	if total == 0 {
+		return 0, 0
+	}
+
+	client, err := s.batch()
+	if err != nil {
+		log.Println("Failed to setup dispatcher:", err)
+		return 0, s.abandon(ctx, groups, err)
+	}
+
+	client.Groups = groups
+
+	err = client.Send(ctx)
+	if err == nil {
+		return total, 0
+	}
+
+	var sendErr *dispatcher.SendError
+	if !errors.As(err, &sendErr) {
+		return 0, s.abandon(ctx, groups, err)
+	}
+
+	failed := make(map[string]dispatcher.Streams)
+
+	for _, f := range sendErr.Failed {
+		if _, ok := failed[f.Group]; !ok {
+			failed[f.Group] = make(dispatcher.Streams)
+		}
+
+		failed[f.Group][f.Stream] = groups[f.Group][f.Stream]
+	}
+
+	abandoned := s.abandon(ctx, failed, err)
+
+	return total - abandoned, abandoned
+}
+
+// Helper function to dead-letter lines which will not be pushed, returning the amount of lines.
+func (s *Server) abandon(ctx context.Context, groups map[string]dispatcher.Streams, err error) int {
+	var records []deadletter.Record
+
+	for group, streams := range groups {
+		for stream, lines := range streams {
+			recordsSkipped.Add(float64(len(lines)), deadletter.ReasonAbandoned)
+			records = append(records, undeliverable(group, stream, lines, deadletter.ReasonAbandoned, err)...)
+		}
+	}
+
+	s.deadLetter(ctx, records)
+
+	return len(records)
+}
+
+// Helper function to sleep unless the server is shut down. Returns false once the server is shut down.
+func (s *Server) wait(delay time.Duration) bool {
+	select {
+	case <-s.stop:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// Helper function to check if the server has been shut down.
+func (s *Server) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Helper function to return a context which is cancelled when the server is shut down.
+func (s *Server) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// Helper function to return a context which is done after a share of the time left before the deadline.
+func share(ctx context.Context, fraction float64) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(float64(time.Until(deadline))*fraction))
+}
+
+// Helper function to wait for a group to finish until the context is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
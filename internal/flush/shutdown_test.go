@@ -0,0 +1,91 @@
+package flush
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter/deadlettertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+)
+
+// Mock API which records the messages which were pushed.
+func TestShutdownDrainsBuffer(t *testing.T) {
+	api := &loggertest.API{}
+
+	server := &Server{
+		Client:              api,
+		BatchSize:           10,
+		Async:               true,
+		BufferFlushSize:     100,
+		BufferFlushInterval: time.Hour,
+	}
+
+	line := `{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"foo","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}`
+
+	assert.Nil(t, server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(line))))
+	assert.Empty(t, api.Messages())
+
+	// Buffered lines are pushed before shutting down.
+	assert.Nil(t, server.Shutdown(context.TODO()))
+	assert.Equal(t, []string{"foo"}, api.Messages())
+	assert.Equal(t, 0, server.buffer.Len())
+}
+
+// API which blocks the first push until its context is done.
+type blockingAPI struct {
+	loggertest.API
+	blocked chan struct{}
+	once    sync.Once
+}
+
+func (m *blockingAPI) PutLogEvents(ctx context.Context, params *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	var first bool
+
+	m.once.Do(func() {
+		first = true
+		close(m.blocked)
+	})
+
+	if first {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return m.API.PutLogEvents(ctx, params, optFns...)
+}
+
+func TestShutdownCancelsPush(t *testing.T) {
+	api := &blockingAPI{blocked: make(chan struct{})}
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Client:              api,
+		BatchSize:           10,
+		Async:               true,
+		BufferFlushSize:     100,
+		BufferFlushInterval: 10 * time.Millisecond,
+		FlushTimeout:        time.Minute,
+		DeadLetter:          sink,
+	}
+
+	line := `{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"foo","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}`
+
+	assert.Nil(t, server.Flush(context.TODO(), json.NewStreamDecoder(strings.NewReader(line))))
+
+	<-api.blocked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The push in progress is cancelled and its lines are drained instead of being abandoned.
+	assert.Nil(t, server.Shutdown(ctx))
+	assert.Equal(t, []string{"foo"}, api.Messages())
+	assert.Empty(t, sink.Records)
+}
@@ -0,0 +1,228 @@
+package flush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+)
+
+// Record in the write-ahead log.
+type walRecord struct {
+	fluentbit.Line
+	// Group and stream of a line which failed to push, so it is pushed to the same stream
+	// again without being routed to the streams which were pushed.
+	Group  string `json:"group,omitempty"`
+	Stream string `json:"stream,omitempty"`
+}
+
+// Decoder for a single line which has already been decoded.
+type lineDecoder struct {
+	line fluentbit.Line
+	done bool
+}
+
+// Next returns the line once, then io.EOF.
+func (d *lineDecoder) Next() (fluentbit.Line, error) {
+	if d.done {
+		return fluentbit.Line{}, io.EOF
+	}
+
+	d.done = true
+
+	return d.line, nil
+}
+
+// Helper function to append lines from a decoder to the write-ahead log.
+func (s *Server) appendWAL(decoder fluentbit.Decoder) error {
+	var records [][]byte
+
+	for {
+		line, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrDecode, err)
+		}
+
+		record, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, record)
+	}
+
+	return s.WAL.Append(records)
+}
+
+// Helper function to push lines from the write-ahead log, until the server is shut down.
+func (s *Server) sendWAL() {
+	defer s.loops.Done()
+
+	// Delay before reading again when the log is empty or a push failed.
+	delay := time.Second
+
+	// Pushes are cancelled when shutting down so their records stay in the log.
+	ctx, cancel := s.context()
+	defer cancel()
+
+	for !s.stopped() {
+		s.activity.beat("write-ahead log")
+
+		records, pos, err := s.WAL.Read(s.WALBatchSize)
+		if err != nil {
+			log.Println("Failed to read write-ahead log:", err)
+			s.wait(delay)
+			continue
+		}
+
+		if len(records) == 0 {
+			s.wait(delay)
+			continue
+		}
+
+		err = s.sendRecords(ctx, records)
+		if err != nil {
+			// The records will be read and pushed again.
+			log.Println("Failed to send logs from write-ahead log:", err)
+			s.wait(delay)
+			continue
+		}
+
+		err = s.WAL.Commit(pos)
+		if err != nil {
+			log.Println("Failed to commit write-ahead log:", err)
+		}
+	}
+}
+
+// Helper function to route and push records from the write-ahead log.
+// Returns an error if all of the records should be pushed again.
+func (s *Server) sendRecords(ctx context.Context, records [][]byte) error {
+	if s.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FlushTimeout)
+		defer cancel()
+	}
+
+	client, err := s.batch()
+	if err != nil {
+		return err
+	}
+
+	// Lines which are unrouted, rejected or undeliverable are dead-lettered together.
+	defer client.deadLetter(ctx)
+
+	// Records are routed one at a time so a bad record doesn't lose the records after it.
+	for _, record := range records {
+		err = s.routeRecord(client, record)
+		if err == nil {
+			continue
+		}
+
+		// Records which cannot be decoded will never succeed, so there is no point retrying them.
+		log.Println("Failed to route logs from write-ahead log:", err)
+
+		reason := deadletter.ReasonUnrouted
+		if errors.Is(err, ErrDecode) {
+			reason = deadletter.ReasonUndecodable
+		}
+
+		client.skip(reason, 1)
+
+		client.add(deadletter.Record{
+			Log:    string(record),
+			Reason: reason,
+			Error:  err.Error(),
+		})
+	}
+
+	err = client.Client.Send(ctx)
+	if err == nil {
+		return nil
+	}
+
+	var sendErr *dispatcher.SendError
+	if !errors.As(err, &sendErr) {
+		return err
+	}
+
+	var retry [][]byte
+
+	for _, failed := range sendErr.Failed {
+		lines := client.Groups[failed.Group][failed.Stream]
+
+		// The push was cancelled by shutting down, timed out or failed with a transient
+		// error, so only the lines of the streams which failed are pushed again.
+		if ctx.Err() != nil || logger.Retryable(failed.Err) || errors.Is(failed.Err, context.DeadlineExceeded) {
+			for _, line := range lines {
+				record, err := json.Marshal(walRecord{
+					Line: fluentbit.Line{
+						Timestamp:  time.UnixMilli(aws.ToInt64(line.Event.Timestamp)),
+						Log:        aws.ToString(line.Event.Message),
+						Kubernetes: line.Source,
+					},
+					Group:  failed.Group,
+					Stream: failed.Stream,
+				})
+				if err != nil {
+					return err
+				}
+
+				retry = append(retry, record)
+			}
+
+			continue
+		}
+
+		// Errors which are not transient would fail again, so there is no point retrying them.
+		log.Printf("Dropping logs for %s/%s from write-ahead log: %s\n", failed.Group, failed.Stream, failed.Err)
+
+		client.skip(deadletter.ReasonUndeliverable, len(lines))
+		client.add(undeliverable(failed.Group, failed.Stream, lines, deadletter.ReasonUndeliverable, failed.Err)...)
+	}
+
+	if len(retry) == 0 {
+		return nil
+	}
+
+	log.Printf("Appending %d lines which failed to push to the write-ahead log: %s\n", len(retry), err)
+
+	// The records are pushed again in full if the lines can't be appended.
+	return s.WAL.Append(retry)
+}
+
+// Helper function to route a record from the write-ahead log. Lines which failed to push
+// are added to the stream they were routed to.
+func (s *Server) routeRecord(client *Batch, record []byte) error {
+	var r walRecord
+
+	err := json.Unmarshal(record, &r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+
+	if r.Group == "" {
+		return s.route(client, &lineDecoder{line: r.Line})
+	}
+
+	err = client.Add(r.Group, r.Stream, r.Line)
+	if err != nil {
+		return fmt.Errorf("failed to add log to dispatcher: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package flush
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter/deadlettertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/wal"
+)
+
+func TestSendRecordsUndecodable(t *testing.T) {
+	api := &loggertest.API{}
+	sink := &deadlettertest.Sink{}
+
+	server := &Server{
+		Client:     api,
+		BatchSize:  10,
+		DeadLetter: sink,
+	}
+
+	server.once.Do(server.init)
+
+	record := func(log string) []byte {
+		return []byte(`{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"` + log + `","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}`)
+	}
+
+	records := [][]byte{record("foo"), []byte(`{"log":`), record("bar")}
+
+	assert.Nil(t, server.sendRecords(context.TODO(), records))
+
+	// Records after the bad record are still pushed.
+	assert.Equal(t, []string{"foo", "bar"}, api.Messages())
+
+	// Only the bad record is dead-lettered.
+	assert.Len(t, sink.Records, 1)
+	assert.Equal(t, deadletter.ReasonUndecodable, sink.Records[0].Reason)
+	assert.Equal(t, `{"log":`, sink.Records[0].Log)
+}
+
+func TestSendRecordsFailedStreams(t *testing.T) {
+	log, err := wal.Open(t.TempDir(), 1024*1024, 1024*1024)
+	assert.Nil(t, err)
+
+	defer log.Close()
+
+	record := func(message, group string) []byte {
+		return []byte(`{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"` + message + `","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"` + group + `"}}}`)
+	}
+
+	assert.Nil(t, log.Append([][]byte{record("foo", "good"), record("bar", "bad")}))
+
+	api := &loggertest.API{Errors: map[string]error{"bad": &types.ServiceUnavailableException{}}}
+
+	server := &Server{
+		Client:    api,
+		BatchSize: 10,
+		WAL:       log,
+	}
+
+	server.once.Do(server.init)
+
+	records, pos, err := log.Read(10)
+	assert.Nil(t, err)
+	assert.Nil(t, server.sendRecords(context.TODO(), records))
+	assert.Nil(t, log.Commit(pos))
+	assert.Equal(t, []string{"foo"}, api.Messages())
+
+	// Only the line of the stream which failed is appended to be pushed again.
+	records, pos, err = log.Read(10)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Contains(t, string(records[0]), `"group":"bad"`)
+
+	delete(api.Errors, "bad")
+
+	assert.Nil(t, server.sendRecords(context.TODO(), records))
+	assert.Nil(t, log.Commit(pos))
+
+	// The stream which was pushed is pushed exactly once.
+	assert.Equal(t, []string{"foo", "bar"}, api.Messages())
+}
@@ -0,0 +1,122 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+// CheckFunc returns an error if the process is not healthy.
+type CheckFunc func(ctx context.Context) error
+
+// Handler which responds with 200 when the check passes and 503 with the reason when it fails.
+func Handler(check CheckFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := check(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+}
+
+// API for checking CloudWatch Logs can be reached.
+type API interface {
+	DescribeLogGroups(ctx context.Context, params *cloudwatchlogs.DescribeLogGroupsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogGroupsOutput, error)
+}
+
+// Readiness which checks that AWS credentials resolve and CloudWatch Logs was reached recently.
+type Readiness struct {
+	// Credentials which are used to sign requests.
+	Credentials aws.CredentialsProvider
+	// Client for making a lightweight call to CloudWatch Logs.
+	Client API
+	// How often CloudWatch Logs is called.
+	Interval time.Duration
+	// How long ago the last successful call can be before the process is not ready.
+	MaxAge time.Duration
+	// Maximum time a call can take.
+	Timeout time.Duration
+	// Lock to protect the fields below.
+	lock sync.Mutex
+	// When CloudWatch Logs was last called successfully.
+	success time.Time
+	// Error from the last call.
+	err error
+}
+
+// Run calls CloudWatch Logs every interval until the context is cancelled.
+func (r *Readiness) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.probe(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Helper function to make a lightweight call to CloudWatch Logs and record the outcome.
+func (r *Readiness) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	_, err := r.Client.DescribeLogGroups(ctx, &cloudwatchlogs.DescribeLogGroupsInput{
+		Limit: aws.Int32(1),
+	})
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.err = err
+
+	if err == nil {
+		r.success = time.Now()
+	}
+}
+
+// Check returns an error if credentials do not resolve or CloudWatch Logs has not been reached recently.
+func (r *Readiness) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	_, err := r.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.success.IsZero() {
+		return r.failure("CloudWatch Logs has not been reached")
+	}
+
+	if age := time.Since(r.success); age > r.MaxAge {
+		return r.failure(fmt.Sprintf("CloudWatch Logs was last reached %s ago", age.Round(time.Second)))
+	}
+
+	return nil
+}
+
+// Helper function to return an error which includes the error from the last call, assumes the lock is held.
+func (r *Readiness) failure(message string) error {
+	if r.err != nil {
+		return fmt.Errorf("%s: %w", message, r.err)
+	}
+
+	return errors.New(message)
+}
@@ -0,0 +1,58 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock API which returns an error.
+type mockAPI struct {
+	err error
+}
+
+func (m *mockAPI) DescribeLogGroups(ctx context.Context, params *cloudwatchlogs.DescribeLogGroupsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return &cloudwatchlogs.DescribeLogGroupsOutput{}, m.err
+}
+
+// Helper function to create credentials which resolve or return an error.
+func credentials(err error) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, err
+	})
+}
+
+func TestReadiness(t *testing.T) {
+	api := &mockAPI{}
+
+	r := &Readiness{
+		Credentials: credentials(nil),
+		Client:      api,
+		MaxAge:      time.Minute,
+		Timeout:     time.Second,
+	}
+
+	// Not ready until CloudWatch Logs has been reached.
+	assert.NotNil(t, r.Check(context.TODO()))
+
+	r.probe(context.TODO())
+	assert.Nil(t, r.Check(context.TODO()))
+
+	// A failed call does not make the process unready until the last success is too old.
+	api.err = errors.New("unreachable")
+	r.probe(context.TODO())
+	assert.Nil(t, r.Check(context.TODO()))
+
+	r.success = time.Now().Add(-2 * time.Minute)
+	assert.ErrorContains(t, r.Check(context.TODO()), "unreachable")
+
+	// Credentials which do not resolve.
+	r.success = time.Now()
+	r.Credentials = credentials(errors.New("expired"))
+	assert.ErrorContains(t, r.Check(context.TODO()), "expired")
+}
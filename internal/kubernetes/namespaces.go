@@ -0,0 +1,345 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Files which are mounted into Pods for their service account.
+	tokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	caFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// How long the API server keeps a watch open before it needs to be started again.
+	watchTimeout = 5 * time.Minute
+	// Amount of Namespaces which are requested per page when listing.
+	listLimit = 500
+)
+
+// NamespaceCache of Namespace annotations which is kept up to date by listing and watching the Kubernetes API.
+type NamespaceCache struct {
+	// Client for calling the Kubernetes API.
+	Client *http.Client
+	// Host of the Kubernetes API eg. https://10.0.0.1:443
+	Host string
+	// File containing the bearer token for the Kubernetes API. Read before every request so rotated tokens are used.
+	TokenFile string
+	// Only annotations with this prefix are cached.
+	Prefix string
+	// Delay before listing again after a watch has failed.
+	Backoff time.Duration
+	// Lock to protect the fields below.
+	lock sync.RWMutex
+	// Annotations for each Namespace.
+	annotations map[string]map[string]string
+	// Closed once the Namespaces have been listed for the first time.
+	synced chan struct{}
+	once   sync.Once
+}
+
+// Namespace object which is returned by the Kubernetes API.
+type namespace struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// NamespaceList which is returned by the Kubernetes API.
+type namespaceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+		Continue        string `json:"continue"`
+	} `json:"metadata"`
+	Items []namespace `json:"items"`
+}
+
+// Event which is streamed when watching the Kubernetes API.
+type event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Status which is returned by the Kubernetes API when a request fails.
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Returned when a watch needs to be started again from a fresh list eg. the resource version has expired.
+var errRelist = errors.New("watch expired")
+
+// InClusterNamespaceCache returns a cache which uses the service account of the Pod it is running in.
+func InClusterNamespaceCache(prefix string) (*NamespaceCache, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse service account certificate: %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return &NamespaceCache{
+		Client:    &http.Client{Transport: transport},
+		Host:      "https://" + net.JoinHostPort(host, port),
+		TokenFile: tokenFile,
+		Prefix:    prefix,
+	}, nil
+}
+
+// Annotations for a Namespace. The returned map must not be modified.
+func (c *NamespaceCache) Annotations(namespace string) map[string]string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.annotations[namespace]
+}
+
+// Wait until the Namespaces have been listed for the first time.
+func (c *NamespaceCache) Wait(ctx context.Context) error {
+	select {
+	case <-c.syncedChan():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run keeps the cache up to date until the context is done.
+func (c *NamespaceCache) Run(ctx context.Context) {
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = 5 * time.Second
+	}
+
+	for ctx.Err() == nil {
+		version, err := c.list(ctx)
+		if err == nil {
+			err = c.watch(ctx, version)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !errors.Is(err, errRelist) {
+			log.Println("Failed to sync namespaces:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Helper function to replace the cache with a fresh list of Namespaces. Returns the version to watch from.
+func (c *NamespaceCache) list(ctx context.Context) (string, error) {
+	var (
+		annotations = make(map[string]map[string]string)
+		query       = url.Values{"limit": {fmt.Sprint(listLimit)}}
+		list        namespaceList
+	)
+
+	for {
+		list = namespaceList{}
+
+		err := c.get(ctx, query, func(body io.Reader) error {
+			return json.NewDecoder(body).Decode(&list)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		for _, ns := range list.Items {
+			annotations[ns.Metadata.Name] = c.filter(ns.Metadata.Annotations)
+		}
+
+		if list.Metadata.Continue == "" {
+			break
+		}
+
+		query.Set("continue", list.Metadata.Continue)
+	}
+
+	c.lock.Lock()
+	c.annotations = annotations
+	c.lock.Unlock()
+
+	c.once.Do(func() {
+		close(c.syncedChan())
+	})
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// Helper function to apply changes to Namespaces until the watch ends.
+func (c *NamespaceCache) watch(ctx context.Context, version string) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	}
+
+	for {
+		err := c.get(ctx, query, func(body io.Reader) error {
+			decoder := json.NewDecoder(body)
+
+			for {
+				var e event
+
+				err := decoder.Decode(&e)
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				if err != nil {
+					return err
+				}
+
+				version, err = c.apply(e)
+				if err != nil {
+					return err
+				}
+
+				query.Set("resourceVersion", version)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Helper function to apply a watch event to the cache. Returns the version to continue watching from.
+func (c *NamespaceCache) apply(e event) (string, error) {
+	if e.Type == "ERROR" {
+		var s status
+
+		err := json.Unmarshal(e.Object, &s)
+		if err != nil {
+			return "", err
+		}
+
+		// The resource version is too old to watch from.
+		if s.Code == http.StatusGone {
+			return "", errRelist
+		}
+
+		return "", fmt.Errorf("watch failed: %d %s", s.Code, s.Message)
+	}
+
+	var ns namespace
+
+	err := json.Unmarshal(e.Object, &ns)
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch e.Type {
+	case "ADDED", "MODIFIED":
+		c.annotations[ns.Metadata.Name] = c.filter(ns.Metadata.Annotations)
+	case "DELETED":
+		delete(c.annotations, ns.Metadata.Name)
+	}
+
+	return ns.Metadata.ResourceVersion, nil
+}
+
+// Helper function to request Namespaces from the Kubernetes API and decode the response.
+func (c *NamespaceCache) get(ctx context.Context, query url.Values, decode func(body io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Host+"/api/v1/namespaces?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if c.TokenFile != "" {
+		token, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errRelist
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return decode(resp.Body)
+}
+
+// Helper function to return the annotations which have the prefix.
+func (c *NamespaceCache) filter(annotations map[string]string) map[string]string {
+	filtered := make(map[string]string)
+
+	for key, value := range annotations {
+		if strings.HasPrefix(key, c.Prefix) {
+			filtered[key] = value
+		}
+	}
+
+	return filtered
+}
+
+// Helper function to return the channel which is closed once synced.
+func (c *NamespaceCache) syncedChan() chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.synced == nil {
+		c.synced = make(chan struct{})
+	}
+
+	return c.synced
+}
@@ -0,0 +1,101 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake Kubernetes API server which lists a single Namespace and streams watch events from a channel.
+type fakeAPI struct {
+	events chan string
+	lists  atomic.Int32
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/namespaces" || r.Header.Get("Authorization") != "Bearer secret" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("watch") != "true" {
+		f.lists.Add(1)
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"items":[{"metadata":{"name":"foo","annotations":{"fluentbit.skpr.io/project":"foo","kubectl.kubernetes.io/last-applied-configuration":"{}"}}}]}`)
+		return
+	}
+
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-f.events:
+			fmt.Fprintln(w, e)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func TestNamespaceCache(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(token, []byte("secret\n"), 0600))
+
+	api := &fakeAPI{events: make(chan string)}
+
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	cache := &NamespaceCache{
+		Host:      server.URL,
+		TokenFile: token,
+		Prefix:    "fluentbit.skpr.io/",
+		Backoff:   time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go cache.Run(ctx)
+
+	assert.Nil(t, cache.Wait(ctx))
+
+	// Only annotations with the prefix are cached.
+	assert.Equal(t, map[string]string{"fluentbit.skpr.io/project": "foo"}, cache.Annotations("foo"))
+	assert.Nil(t, cache.Annotations("bar"))
+
+	api.events <- `{"type":"ADDED","object":{"metadata":{"name":"bar","resourceVersion":"2","annotations":{"fluentbit.skpr.io/environment":"dev"}}}}`
+	api.events <- `{"type":"DELETED","object":{"metadata":{"name":"foo","resourceVersion":"3"}}}`
+	api.events <- `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"4"}}}`
+
+	assert.Eventually(t, func() bool {
+		return cache.Annotations("foo") == nil && cache.Annotations("bar")["fluentbit.skpr.io/environment"] == "dev"
+	}, time.Second, time.Millisecond)
+
+	// Namespaces are listed again when the watch has expired.
+	api.events <- `{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`
+
+	assert.Eventually(t, func() bool {
+		return api.lists.Load() == 2 && cache.Annotations("foo") != nil && cache.Annotations("bar") == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestNamespaceCacheUnauthorized(t *testing.T) {
+	server := httptest.NewServer(&fakeAPI{})
+	defer server.Close()
+
+	cache := &NamespaceCache{
+		Host: server.URL,
+	}
+
+	_, err := cache.list(context.Background())
+	assert.ErrorContains(t, err, "unexpected status 403: forbidden")
+}
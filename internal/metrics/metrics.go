@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// Namespace which all metrics are prefixed with.
+	Namespace = "fluentbit_cloudwatchlogs"
+	// MaxSeries is the amount of label combinations a metric can have. Label values
+	// beyond this are reported as OverflowValue to keep cardinality bounded.
+	MaxSeries = 500
+	// OverflowValue is used for label values once a metric has MaxSeries series.
+	OverflowValue = "other"
+)
+
+// DefaultBuckets for histograms which measure durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Registry which metrics are registered with, along with process and Go runtime metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	)
+}
+
+// Handler which serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Label values which have been used by a metric, used to bound its cardinality.
+type series struct {
+	lock sync.Mutex
+	seen map[string]struct{}
+}
+
+// Helper function to return the label values to use, collapsing new combinations into
+// OverflowValue once the metric has MaxSeries series.
+func (s *series) values(values []string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := strings.Join(values, "\xff")
+
+	if _, ok := s.seen[key]; ok {
+		return values
+	}
+
+	if len(s.seen) >= MaxSeries {
+		overflow := make([]string, len(values))
+		for i := range overflow {
+			overflow[i] = OverflowValue
+		}
+
+		values = overflow
+		key = strings.Join(values, "\xff")
+	}
+
+	s.seen[key] = struct{}{}
+
+	return values
+}
+
+// Helper function to create the series tracking for a metric.
+func newSeries() *series {
+	return &series{seen: make(map[string]struct{})}
+}
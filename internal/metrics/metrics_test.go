@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to read the value of a counter for label values, without creating the series.
+func value(c *Counter, values ...string) float64 {
+	c.series.lock.Lock()
+	_, ok := c.series.seen[strings.Join(values, "\xff")]
+	c.series.lock.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	var m dto.Metric
+
+	err := c.vec.WithLabelValues(values...).Write(&m)
+	if err != nil {
+		return 0
+	}
+
+	return m.GetCounter().GetValue()
+}
+
+// Helper function to scrape the metrics handler.
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	return w.Body.String()
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("test_counter_total", "Test counter.", "code")
+
+	counter.Inc("Throttling")
+	counter.Add(2, "Throttling")
+	counter.Inc(`quote"`)
+
+	body := scrape(t)
+
+	assert.Contains(t, body, "# TYPE fluentbit_cloudwatchlogs_test_counter_total counter\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_counter_total{code=\"Throttling\"} 3\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_counter_total{code=\"quote\\\"\"} 1\n")
+	assert.Equal(t, float64(3), value(counter, "Throttling"))
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram("test_duration_seconds", "Test histogram.", []float64{1, 0.1})
+
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	body := scrape(t)
+
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_duration_seconds_bucket{le=\"0.1\"} 1\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_duration_seconds_bucket{le=\"1\"} 2\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_duration_seconds_bucket{le=\"+Inf\"} 3\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_duration_seconds_sum 5.55\n")
+	assert.Contains(t, body, "fluentbit_cloudwatchlogs_test_duration_seconds_count 3\n")
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	body := scrape(t)
+
+	assert.Contains(t, body, "go_goroutines ")
+	assert.Contains(t, body, "process_resident_memory_bytes ")
+}
+
+func TestMaxSeries(t *testing.T) {
+	counter := NewCounter("test_series_total", "Test series.", "pod")
+
+	for i := 0; i < MaxSeries+10; i++ {
+		counter.Inc(fmt.Sprintf("pod-%d", i))
+	}
+
+	// Label values beyond the limit are collapsed into a single series.
+	assert.Len(t, counter.series.seen, MaxSeries+1)
+	assert.Equal(t, float64(10), value(counter, OverflowValue))
+}
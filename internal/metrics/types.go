@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Counter which only goes up, partitioned by labels.
+type Counter struct {
+	vec    *prometheus.CounterVec
+	series *series
+}
+
+// NewCounter registers a counter with the registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, labels)
+
+	Registry.MustRegister(vec)
+
+	return &Counter{vec: vec, series: newSeries()}
+}
+
+// Inc increments the counter for label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add a value to the counter for label values.
+func (c *Counter) Add(value float64, values ...string) {
+	c.vec.WithLabelValues(c.series.values(values)...).Add(value)
+}
+
+// Gauge which can go up and down, partitioned by labels.
+type Gauge struct {
+	vec    *prometheus.GaugeVec
+	series *series
+}
+
+// NewGauge registers a gauge with the registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, labels)
+
+	Registry.MustRegister(vec)
+
+	return &Gauge{vec: vec, series: newSeries()}
+}
+
+// Add a value to the gauge for label values. The value can be negative.
+func (g *Gauge) Add(value float64, values ...string) {
+	g.vec.WithLabelValues(g.series.values(values)...).Add(value)
+}
+
+// Set the gauge for label values.
+func (g *Gauge) Set(value float64, values ...string) {
+	g.vec.WithLabelValues(g.series.values(values)...).Set(value)
+}
+
+// Histogram which counts observations into buckets, partitioned by labels.
+type Histogram struct {
+	vec    *prometheus.HistogramVec
+	series *series
+}
+
+// NewHistogram registers a histogram with the registry.
+// Buckets are the upper bounds of each bucket, a +Inf bucket is always added.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+
+	Registry.MustRegister(vec)
+
+	return &Histogram{vec: vec, series: newSeries()}
+}
+
+// Observe a value for label values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.vec.WithLabelValues(h.series.values(values)...).Observe(value)
+}
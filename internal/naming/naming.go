@@ -0,0 +1,115 @@
+package naming
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Data which is available to templates.
+type Data struct {
+	Prefix    string
+	Cluster   string
+	Namespace string
+	Pod       string
+	Container string
+	// Node which the Pod is running on.
+	Node        string
+	Labels      map[string]string
+	Annotations map[string]string
+	// Time of the line, used for date based names eg. {{ .Time.Format "2006/01/02" }}
+	Time time.Time
+}
+
+// Date of the line in UTC eg. 2006-01-02
+func (d Data) Date() string {
+	return d.Time.UTC().Format("2006-01-02")
+}
+
+// Annotation returns the value of an annotation, failing the template if it is not set.
+func (d Data) Annotation(key string) (string, error) {
+	if _, ok := d.Annotations[key]; !ok {
+		return "", fmt.Errorf("not found: %s", key)
+	}
+
+	return d.Annotations[key], nil
+}
+
+// Label returns the value of a label, failing the template if it is not set.
+func (d Data) Label(key string) (string, error) {
+	if _, ok := d.Labels[key]; !ok {
+		return "", fmt.Errorf("not found: %s", key)
+	}
+
+	return d.Labels[key], nil
+}
+
+// Characters which are not allowed in CloudWatch Logs group and stream names.
+var invalid = regexp.MustCompile(`[^a-zA-Z0-9_\-/.#]`)
+
+// Functions which are available to templates.
+var funcs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	// Replace all instances of old with new eg. {{ .Namespace | replace "-" "_" }}
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	// Replace characters which CloudWatch Logs does not allow with a dash.
+	"sanitize": func(s string) string {
+		return invalid.ReplaceAllString(s, "-")
+	},
+}
+
+// Template for naming a log group or stream.
+type Template struct {
+	tmpl *template.Template
+}
+
+// Parse a Go text/template.
+func Parse(name, text string) (*Template, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Template{tmpl: tmpl}, nil
+}
+
+// MustParse is like Parse but panics if the template cannot be parsed.
+func MustParse(name, text string) *Template {
+	t, err := Parse(name, text)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// Execute the template, returning an error if it produces an empty name.
+func (t *Template) Execute(data Data) (string, error) {
+	var buf bytes.Buffer
+
+	err := t.tmpl.Execute(&buf, data)
+	if err != nil {
+		// Unwrap errors returned by functions, such as a missing annotation, so they are readable.
+		var execErr template.ExecError
+		if errors.As(err, &execErr) && errors.Unwrap(execErr.Err) != nil {
+			return "", errors.Unwrap(execErr.Err)
+		}
+
+		return "", err
+	}
+
+	name := strings.TrimSpace(buf.String())
+	if name == "" {
+		return "", fmt.Errorf("%s template produced an empty name", t.tmpl.Name())
+	}
+
+	return name, nil
+}
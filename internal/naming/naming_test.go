@@ -0,0 +1,47 @@
+package naming
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecute(t *testing.T) {
+	tmpl, err := Parse("group", `/{{ .Prefix }}/{{ .Namespace | lower | replace "_" "-" }}/{{ index .Labels "app" | sanitize }}`)
+	assert.Nil(t, err)
+
+	name, err := tmpl.Execute(Data{
+		Prefix:    "skpr",
+		Namespace: "My_Namespace",
+		Labels: map[string]string{
+			"app": "web:frontend",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/skpr/my-namespace/web-frontend", name)
+}
+
+func TestExecuteAnnotation(t *testing.T) {
+	tmpl, err := Parse("group", `{{ .Annotation "fluentbit.skpr.io/project" }}`)
+	assert.Nil(t, err)
+
+	name, err := tmpl.Execute(Data{
+		Annotations: map[string]string{
+			"fluentbit.skpr.io/project": "project",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "project", name)
+
+	// A missing annotation fails the template.
+	_, err = tmpl.Execute(Data{})
+	assert.EqualError(t, err, "not found: fluentbit.skpr.io/project")
+}
+
+func TestExecuteEmpty(t *testing.T) {
+	tmpl, err := Parse("group", `{{ index .Labels "missing" }}`)
+	assert.Nil(t, err)
+
+	_, err = tmpl.Execute(Data{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/dispatcher"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit/json"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/flush"
+)
+
+// Replayer which pushes lines from a file back through routing and the dispatcher.
+type Replayer struct {
+	// Server which routes and pushes lines.
+	Server *flush.Server
+	// Amount of lines which are routed and pushed at a time.
+	BatchSize int
+	// Maximum amount of lines pushed per second. Unlimited when zero.
+	Rate float64
+	// Amount of lines to skip before replaying, used to resume an earlier replay.
+	Offset int
+	// Route lines and report where they would be pushed without pushing them.
+	DryRun bool
+	// Output for progress and dry run reports.
+	Output io.Writer
+	// Amount of lines which were not pushed, by reason.
+	skipped map[string]int
+}
+
+// Replay lines from a reader containing newline delimited JSON or a Fluent Bit JSON array.
+//
+// Returns the offset of the lines which have been replayed, which can be used to resume
+// the replay if it fails. Lines which were skipped are reported separately, they are
+// dead-lettered again when the server has a dead-letter sink.
+func (r *Replayer) Replay(ctx context.Context, reader io.Reader) (int, error) {
+	r.skipped = make(map[string]int)
+
+	offset, err := r.replay(ctx, reader)
+
+	if len(r.skipped) > 0 {
+		fmt.Fprintf(r.Output, "Skipped %s\n", summary(r.skipped))
+	}
+
+	return offset, err
+}
+
+// Skipped returns the amount of lines which were not pushed by the last replay, by reason.
+func (r *Replayer) Skipped() map[string]int {
+	return r.skipped
+}
+
+// Helper function to replay lines from a reader.
+func (r *Replayer) replay(ctx context.Context, reader io.Reader) (int, error) {
+	// A Fluent Bit JSON array starts with "[", otherwise the reader is treated as newline delimited JSON.
+	decoder := json.NewDetectDecoder(reader)
+
+	offset := 0
+
+	for ; offset < r.Offset; offset++ {
+		_, err := decoder.Next()
+		if err == io.EOF {
+			return offset, nil
+		}
+
+		if err != nil {
+			return offset, fmt.Errorf("failed to skip to offset: %w", err)
+		}
+	}
+
+	start := time.Now()
+	replayed := 0
+
+	for {
+		batch := &limitDecoder{decoder: decoder, limit: r.BatchSize}
+
+		client, err := r.Server.Route(batch)
+		if err != nil {
+			return offset, err
+		}
+
+		if batch.count == 0 {
+			return offset, nil
+		}
+
+		if r.DryRun {
+			report(r.Output, client.Groups)
+		} else {
+			err = client.Send(ctx)
+			if err != nil {
+				return offset, err
+			}
+		}
+
+		offset += batch.count
+		replayed += batch.count
+
+		skipped := client.Skipped()
+
+		if len(skipped) == 0 {
+			fmt.Fprintf(r.Output, "Replayed %d lines, offset is %d\n", batch.count, offset)
+		} else {
+			fmt.Fprintf(r.Output, "Replayed %d lines and skipped %s, offset is %d\n", batch.count-total(skipped), summary(skipped), offset)
+		}
+
+		for reason, count := range skipped {
+			r.skipped[reason] += count
+		}
+
+		if batch.done {
+			return offset, nil
+		}
+
+		err = r.wait(ctx, start, replayed)
+		if err != nil {
+			return offset, err
+		}
+	}
+}
+
+// Helper function to wait until pushing more lines would not exceed the rate limit.
+func (r *Replayer) wait(ctx context.Context, start time.Time, replayed int) error {
+	if r.Rate <= 0 {
+		return nil
+	}
+
+	delay := time.Until(start.Add(time.Duration(float64(replayed) / r.Rate * float64(time.Second))))
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Helper function to report the amount of lines which would be pushed to each stream.
+func report(w io.Writer, groups map[string]dispatcher.Streams) {
+	var names []string
+
+	for group, streams := range groups {
+		for stream, lines := range streams {
+			names = append(names, fmt.Sprintf("%s/%s: %d lines", group, stream, len(lines)))
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+// Helper function to return the total amount of lines which were skipped.
+func total(skipped map[string]int) int {
+	var n int
+
+	for _, count := range skipped {
+		n += count
+	}
+
+	return n
+}
+
+// Helper function to describe the amount of lines which were skipped for each reason.
+func summary(skipped map[string]int) string {
+	var reasons []string
+
+	for reason, count := range skipped {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+
+	sort.Strings(reasons)
+
+	return fmt.Sprintf("%d lines (%s)", total(skipped), strings.Join(reasons, ", "))
+}
+
+// Decoder which stops after a limited amount of lines.
+type limitDecoder struct {
+	decoder fluentbit.Decoder
+	limit   int
+	// Amount of lines which have been decoded.
+	count int
+	// Set once the underlying decoder has no more lines.
+	done bool
+}
+
+// Next line, or io.EOF once the limit has been reached.
+func (d *limitDecoder) Next() (fluentbit.Line, error) {
+	if d.done || (d.limit > 0 && d.count >= d.limit) {
+		return fluentbit.Line{}, io.EOF
+	}
+
+	line, err := d.decoder.Next()
+	if err == io.EOF {
+		d.done = true
+	}
+
+	if err != nil {
+		return line, err
+	}
+
+	d.count++
+
+	return line, nil
+}
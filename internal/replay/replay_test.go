@@ -0,0 +1,100 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/aws/cloudwatchlogs/logger/loggertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/deadletter/deadlettertest"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/flush"
+)
+
+// Helper function to create a line which routes to a group.
+func line(message string) string {
+	return `{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"` + message + `","kubernetes":{"container_name":"app","annotations":{"fluentbit.skpr.io/group-override":"group"}}}`
+}
+
+func TestReplayLines(t *testing.T) {
+	api := &loggertest.API{}
+
+	replayer := &Replayer{
+		Server:    &flush.Server{Client: api, BatchSize: 10},
+		BatchSize: 2,
+		Offset:    1,
+		Output:    &bytes.Buffer{},
+	}
+
+	input := strings.Join([]string{line("one"), line("two"), line("three"), line("four")}, "\n")
+
+	offset, err := replayer.Replay(context.TODO(), strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, offset)
+
+	// Lines before the offset are skipped.
+	assert.Equal(t, []string{"two", "three", "four"}, api.Messages())
+}
+
+func TestReplayArray(t *testing.T) {
+	api := &loggertest.API{}
+
+	replayer := &Replayer{
+		Server: &flush.Server{Client: api, BatchSize: 10},
+		Output: &bytes.Buffer{},
+	}
+
+	input := "\n [" + line("one") + "," + line("two") + "]"
+
+	offset, err := replayer.Replay(context.TODO(), strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, offset)
+	assert.Equal(t, []string{"one", "two"}, api.Messages())
+}
+
+func TestReplayDryRun(t *testing.T) {
+	api := &loggertest.API{}
+	output := &bytes.Buffer{}
+
+	replayer := &Replayer{
+		Server: &flush.Server{Client: api, BatchSize: 10},
+		DryRun: true,
+		Output: output,
+	}
+
+	_, err := replayer.Replay(context.TODO(), strings.NewReader(line("one")+"\n"+line("two")))
+	assert.Nil(t, err)
+
+	assert.Empty(t, api.Messages())
+	assert.Contains(t, output.String(), "group/app: 2 lines")
+}
+
+func TestReplaySkipped(t *testing.T) {
+	api := &loggertest.API{}
+	sink := &deadlettertest.Sink{}
+	output := &bytes.Buffer{}
+
+	replayer := &Replayer{
+		Server: &flush.Server{Client: api, BatchSize: 10, DeadLetter: sink},
+		Output: output,
+	}
+
+	// A line without annotations can't be named by the default group template.
+	unrouted := `{"timestamp":"` + time.Now().Format(time.RFC3339) + `","log":"two","kubernetes":{"container_name":"app"}}`
+
+	offset, err := replayer.Replay(context.TODO(), strings.NewReader(line("one")+"\n"+unrouted))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, offset)
+
+	assert.Equal(t, []string{"one"}, api.Messages())
+	assert.Equal(t, map[string]int{deadletter.ReasonUnrouted: 1}, replayer.Skipped())
+
+	// Lines which still can't be routed are dead-lettered again and reported.
+	assert.Len(t, sink.Records, 1)
+	assert.Equal(t, "two", sink.Records[0].Log)
+	assert.Contains(t, output.String(), "Replayed 1 lines and skipped 1 lines (1 unrouted)")
+}
@@ -0,0 +1,259 @@
+package routing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+)
+
+// Rules which are evaluated in order to decide where a line is routed.
+type Rules struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule which routes lines that match it.
+type Rule struct {
+	// Name which is reported when the rule matches. Defaults to "rule-N".
+	Name string `yaml:"name"`
+	// Conditions which must all be met for the rule to match.
+	Match Match `yaml:"match"`
+	// Template for the log group, shorthand for a single destination.
+	Group string `yaml:"group"`
+	// Template for the log stream, shorthand for a single destination.
+	Stream string `yaml:"stream"`
+	// Destinations which the line is pushed to.
+	Destinations []Destination `yaml:"destinations"`
+	// Drop the line instead of pushing it.
+	Drop bool `yaml:"drop"`
+	// Keep evaluating rules after this one matches.
+	Continue bool `yaml:"continue"`
+
+	pod     *regexp.Regexp
+	message *regexp.Regexp
+	targets []Target
+}
+
+// Match conditions for a rule. Conditions which are not set always match.
+type Match struct {
+	// Namespace which the Pod belongs to.
+	Namespace string `yaml:"namespace"`
+	// Regular expression which the Pod name matches.
+	Pod string `yaml:"pod"`
+	// Container which the line came from.
+	Container string `yaml:"container"`
+	// Labels which the Pod has.
+	Labels map[string]string `yaml:"labels"`
+	// Annotations which the Pod has.
+	Annotations map[string]string `yaml:"annotations"`
+	// Regular expression which the message matches.
+	Message string `yaml:"message"`
+}
+
+// Destination which a line is pushed to. Templates which are not set fall back to the defaults.
+type Destination struct {
+	Group  string `yaml:"group"`
+	Stream string `yaml:"stream"`
+}
+
+// Target is a compiled destination. Templates are nil when the default should be used.
+type Target struct {
+	Group  *naming.Template
+	Stream *naming.Template
+}
+
+// Result of evaluating the rules for a line.
+type Result struct {
+	// Names of the rules which matched, in order.
+	Rules []string
+	// Targets which the line is pushed to.
+	Targets []Target
+	// Set if a rule dropped the line.
+	Drop bool
+}
+
+// Load rules from a YAML or JSON file.
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+// Parse rules from YAML or JSON.
+func Parse(data []byte) (*Rules, error) {
+	var rules Rules
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(&rules)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule.Name, err)
+		}
+	}
+
+	return &rules, nil
+}
+
+// Evaluate the rules for a line.
+//
+// Rules are evaluated in order until one matches which does not continue. When no such rule
+// matches the default destination is used. A rule which drops the line stops evaluation, but
+// destinations from earlier rules which continued still receive it.
+func (r *Rules) Evaluate(line fluentbit.Line) Result {
+	var result Result
+
+	if r != nil {
+		for _, rule := range r.Rules {
+			if !rule.matches(line) {
+				continue
+			}
+
+			result.Rules = append(result.Rules, rule.Name)
+
+			if rule.Drop {
+				result.Drop = true
+				return result
+			}
+
+			result.Targets = append(result.Targets, rule.targets...)
+
+			if !rule.Continue {
+				return result
+			}
+		}
+	}
+
+	result.Targets = append(result.Targets, Target{})
+
+	return result
+}
+
+// Helper function to validate a rule and compile its expressions and templates.
+func (r *Rule) compile() error {
+	var err error
+
+	if r.Match.Pod != "" {
+		r.pod, err = regexp.Compile(r.Match.Pod)
+		if err != nil {
+			return fmt.Errorf("invalid pod expression: %w", err)
+		}
+	}
+
+	if r.Match.Message != "" {
+		r.message, err = regexp.Compile(r.Match.Message)
+		if err != nil {
+			return fmt.Errorf("invalid message expression: %w", err)
+		}
+	}
+
+	destinations := r.Destinations
+
+	if r.Group != "" || r.Stream != "" {
+		destinations = append([]Destination{{Group: r.Group, Stream: r.Stream}}, destinations...)
+	}
+
+	if r.Drop {
+		if len(destinations) > 0 {
+			return fmt.Errorf("cannot drop and set destinations")
+		}
+
+		if r.Continue {
+			return fmt.Errorf("cannot drop and continue")
+		}
+
+		return nil
+	}
+
+	// A rule without destinations routes to the default destination.
+	if len(destinations) == 0 {
+		destinations = []Destination{{}}
+	}
+
+	for _, destination := range destinations {
+		var target Target
+
+		if destination.Group != "" {
+			target.Group, err = naming.Parse(r.Name, destination.Group)
+			if err != nil {
+				return fmt.Errorf("invalid group template: %w", err)
+			}
+		}
+
+		if destination.Stream != "" {
+			target.Stream, err = naming.Parse(r.Name, destination.Stream)
+			if err != nil {
+				return fmt.Errorf("invalid stream template: %w", err)
+			}
+		}
+
+		r.targets = append(r.targets, target)
+	}
+
+	return nil
+}
+
+// Helper function to check if a line meets all of the conditions of a rule.
+func (r *Rule) matches(line fluentbit.Line) bool {
+	if r.Match.Namespace != "" && r.Match.Namespace != line.Kubernetes.Namespace {
+		return false
+	}
+
+	if r.pod != nil && !r.pod.MatchString(line.Kubernetes.Pod) {
+		return false
+	}
+
+	if r.Match.Container != "" && r.Match.Container != line.Kubernetes.Container {
+		return false
+	}
+
+	if !contains(line.Kubernetes.Labels, r.Match.Labels) {
+		return false
+	}
+
+	if !contains(line.Kubernetes.Annotations, r.Match.Annotations) {
+		return false
+	}
+
+	if r.message != nil && !r.message.MatchString(line.Log) {
+		return false
+	}
+
+	return true
+}
+
+// Helper function to check if a map contains all of the expected keys and values.
+func contains(actual, expected map[string]string) bool {
+	for key, value := range expected {
+		if v, ok := actual[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/fluentbit"
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/naming"
+)
+
+const example = `
+rules:
+  - name: health-checks
+    match:
+      message: "GET /healthz"
+    drop: true
+  - name: audit
+    match:
+      labels:
+        audit: "true"
+    group: "/audit/{{ .Namespace }}"
+    continue: true
+  - name: batch
+    match:
+      namespace: jobs
+      pod: "^cron-"
+    destinations:
+      - group: "/jobs"
+        stream: "{{ .Pod }}"
+      - group: "/archive"
+`
+
+// Helper function to return the group and stream names for targets.
+func names(t *testing.T, targets []Target) []string {
+	var names []string
+
+	data := naming.Data{
+		Namespace: "jobs",
+		Pod:       "cron-123",
+		Container: "app",
+	}
+
+	for _, target := range targets {
+		group, stream := "default", "default"
+
+		var err error
+
+		if target.Group != nil {
+			group, err = target.Group.Execute(data)
+			assert.Nil(t, err)
+		}
+
+		if target.Stream != nil {
+			stream, err = target.Stream.Execute(data)
+			assert.Nil(t, err)
+		}
+
+		names = append(names, group+":"+stream)
+	}
+
+	return names
+}
+
+func TestEvaluate(t *testing.T) {
+	rules, err := Parse([]byte(example))
+	assert.Nil(t, err)
+
+	// Lines which don't match any rules use the default destination.
+	result := rules.Evaluate(fluentbit.Line{Log: "foo"})
+	assert.Nil(t, result.Rules)
+	assert.Equal(t, []string{"default:default"}, names(t, result.Targets))
+
+	// Lines which match a rule which continues are also pushed to the default destination.
+	result = rules.Evaluate(fluentbit.Line{
+		Log: "foo",
+		Kubernetes: fluentbit.Kubernetes{
+			Labels: map[string]string{"audit": "true"},
+		},
+	})
+	assert.Equal(t, []string{"audit"}, result.Rules)
+	assert.Equal(t, []string{"/audit/jobs:default", "default:default"}, names(t, result.Targets))
+
+	// Lines which match a rule with multiple destinations.
+	result = rules.Evaluate(fluentbit.Line{
+		Log: "foo",
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "jobs",
+			Pod:       "cron-123",
+			Labels:    map[string]string{"audit": "true"},
+		},
+	})
+	assert.Equal(t, []string{"audit", "batch"}, result.Rules)
+	assert.Equal(t, []string{"/audit/jobs:default", "/jobs:cron-123", "/archive:default"}, names(t, result.Targets))
+
+	// Lines which don't match all of the conditions.
+	result = rules.Evaluate(fluentbit.Line{
+		Log: "foo",
+		Kubernetes: fluentbit.Kubernetes{
+			Namespace: "jobs",
+			Pod:       "web-123",
+		},
+	})
+	assert.Nil(t, result.Rules)
+
+	// Lines which are dropped.
+	result = rules.Evaluate(fluentbit.Line{Log: "GET /healthz 200"})
+	assert.Equal(t, []string{"health-checks"}, result.Rules)
+	assert.True(t, result.Drop)
+	assert.Empty(t, result.Targets)
+}
+
+func TestEvaluateNil(t *testing.T) {
+	var rules *Rules
+
+	result := rules.Evaluate(fluentbit.Line{Log: "foo"})
+	assert.Equal(t, []Target{{}}, result.Targets)
+}
+
+func TestParse(t *testing.T) {
+	// JSON is also supported.
+	rules, err := Parse([]byte(`{"rules": [{"match": {"container": "nginx"}, "stream": "{{ .Pod }}"}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "rule-1", rules.Rules[0].Name)
+
+	_, err = Parse([]byte(`{"rules": [{"match": {"pod": "("}}]}`))
+	assert.ErrorContains(t, err, "invalid pod expression")
+
+	_, err = Parse([]byte(`{"rules": [{"drop": true, "group": "/foo"}]}`))
+	assert.ErrorContains(t, err, "cannot drop and set destinations")
+
+	_, err = Parse([]byte(`{"rules": [{"drop": true, "continue": true}]}`))
+	assert.ErrorContains(t, err, "cannot drop and continue")
+
+	_, err = Parse([]byte(`{"rules": [{"group": "{{ .Missing"}]}`))
+	assert.ErrorContains(t, err, "invalid group template")
+
+	_, err = Parse([]byte(`{"rules": [{"matches": {}}]}`))
+	assert.ErrorContains(t, err, "field matches not found")
+}
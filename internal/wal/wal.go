@@ -0,0 +1,425 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/skpr/fluentbit-cloudwatchlogs/internal/metrics"
+)
+
+const (
+	// DefaultSegmentSize is used when a segment size is not provided.
+	DefaultSegmentSize = 16 * 1024 * 1024
+	// Extension of segment files.
+	segmentExt = ".log"
+	// Name of the file which stores the checkpoint.
+	checkpointFile = "checkpoint"
+)
+
+var (
+	evictedBytes    = metrics.NewCounter("wal_evicted_bytes_total", "Bytes which were evicted from the write-ahead log before they were read.")
+	evictedSegments = metrics.NewCounter("wal_evicted_segments_total", "Segments which were evicted from the write-ahead log before they were read.")
+)
+
+// Position of a record in the log.
+type Position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Log of newline delimited records stored in segment files on disk.
+//
+// Records are appended to the newest segment and read from a checkpoint which
+// is persisted once records have been processed. Segments are removed once they
+// have been read, or evicted oldest first when the log exceeds its size budget.
+type Log struct {
+	// Directory where segments and the checkpoint are stored.
+	dir string
+	// Size at which a new segment is started.
+	segmentSize int64
+	// Maximum size of all segments before the oldest are evicted. Unlimited when zero.
+	maxSize int64
+	// Lock to protect the fields below.
+	lock sync.Mutex
+	// Segments on disk ordered oldest first, the last segment is being appended to.
+	segments []segment
+	// File for the segment being appended to.
+	active *os.File
+	// Position which reading will resume from.
+	checkpoint Position
+}
+
+// Segment file on disk.
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// Open a log in a directory, creating it if it does not exist.
+func Open(dir string, segmentSize, maxSize int64) (*Log, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	l := &Log{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+	}
+
+	err = l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Helper function to load segments and the checkpoint from disk.
+func (l *Log) load() error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		l.segments = append(l.segments, segment{id: id, size: info.Size()})
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].id < l.segments[j].id
+	})
+
+	if len(l.segments) > 0 {
+		l.checkpoint = Position{Segment: l.segments[0].id}
+	}
+
+	data, err := os.ReadFile(filepath.Join(l.dir, checkpointFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &l.checkpoint)
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+	}
+
+	// Always append to a new segment so a partial write from a previous process
+	// cannot be joined with new records.
+	return l.rotate()
+}
+
+// Helper function to return the path of a segment.
+func (l *Log) path(id uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// Helper function to start a new segment, assumes the lock is held.
+func (l *Log) rotate() error {
+	var id uint64 = 1
+
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1].id + 1
+	}
+
+	f, err := os.OpenFile(l.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if l.active != nil {
+		err = l.active.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.active = f
+	l.segments = append(l.segments, segment{id: id})
+
+	if l.checkpoint.Segment == 0 {
+		l.checkpoint = Position{Segment: id}
+	}
+
+	return nil
+}
+
+// Append records to the log. Records must not contain newlines.
+// The records are synced to disk before Append returns.
+func (l *Log) Append(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	for _, record := range records {
+		if bytes.IndexByte(record, '\n') >= 0 {
+			return fmt.Errorf("record contains a newline")
+		}
+
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.segments[len(l.segments)-1].size > 0 && l.segments[len(l.segments)-1].size+int64(buf.Len()) > l.segmentSize {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.active.Write(buf.Bytes())
+	l.segments[len(l.segments)-1].size += int64(n)
+
+	if err != nil {
+		return err
+	}
+
+	err = l.active.Sync()
+	if err != nil {
+		return err
+	}
+
+	return l.evict()
+}
+
+// Helper function to remove the oldest segments while the log exceeds its size budget, assumes the lock is held.
+func (l *Log) evict() error {
+	if l.maxSize <= 0 {
+		return nil
+	}
+
+	for len(l.segments) > 1 && l.size() > l.maxSize {
+		oldest := l.segments[0]
+
+		err := os.Remove(l.path(oldest.id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		l.segments = l.segments[1:]
+
+		if l.checkpoint.Segment <= oldest.id {
+			unread := oldest.size
+			if l.checkpoint.Segment == oldest.id {
+				unread -= l.checkpoint.Offset
+			}
+
+			evictedBytes.Add(float64(unread))
+			evictedSegments.Inc()
+
+			l.checkpoint = Position{Segment: l.segments[0].id}
+
+			err = l.saveCheckpoint()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Helper function to return the size of all segments, assumes the lock is held.
+func (l *Log) size() int64 {
+	var total int64
+
+	for _, s := range l.segments {
+		total += s.size
+	}
+
+	return total
+}
+
+// Read up to max records from the checkpoint.
+//
+// The returned position should be passed to Commit once the records have been processed.
+// Reading again before committing returns the same records.
+func (l *Log) Read(max int) ([][]byte, Position, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var records [][]byte
+
+	pos := l.checkpoint
+
+	for i, s := range l.segments {
+		if s.id < pos.Segment {
+			continue
+		}
+
+		if s.id > pos.Segment {
+			pos = Position{Segment: s.id}
+		}
+
+		last := i == len(l.segments)-1
+
+		read, offset, err := l.readSegment(pos, max-len(records))
+		if err != nil {
+			return nil, l.checkpoint, err
+		}
+
+		records = append(records, read...)
+		pos.Offset = offset
+
+		// Move onto the next segment unless we have enough records or this is the
+		// segment being appended to. A sealed segment which ends with an incomplete
+		// record was interrupted by a crash, so the incomplete record is skipped.
+		if len(records) >= max || last {
+			break
+		}
+	}
+
+	return records, pos, nil
+}
+
+// Helper function to read complete records from a segment, returning the offset after the last record.
+func (l *Log) readSegment(pos Position, max int) ([][]byte, int64, error) {
+	f, err := os.Open(l.path(pos.Segment))
+	if os.IsNotExist(err) {
+		return nil, pos.Offset, nil
+	}
+
+	if err != nil {
+		return nil, pos.Offset, err
+	}
+
+	defer f.Close()
+
+	_, err = f.Seek(pos.Offset, io.SeekStart)
+	if err != nil {
+		return nil, pos.Offset, err
+	}
+
+	var records [][]byte
+
+	offset := pos.Offset
+	r := bufio.NewReader(f)
+
+	for len(records) < max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Incomplete records are left to be read once they have been completed.
+			break
+		}
+
+		if err != nil {
+			return nil, pos.Offset, err
+		}
+
+		offset += int64(len(line))
+		records = append(records, line[:len(line)-1])
+	}
+
+	return records, offset, nil
+}
+
+// Commit a position returned by Read so the records before it are not read again.
+// Segments which have been completely read are removed.
+func (l *Log) Commit(pos Position) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// The position was evicted while the records were being processed.
+	if pos.Segment < l.checkpoint.Segment {
+		return nil
+	}
+
+	l.checkpoint = pos
+
+	for len(l.segments) > 1 && l.segments[0].id < pos.Segment {
+		err := os.Remove(l.path(l.segments[0].id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		l.segments = l.segments[1:]
+	}
+
+	return l.saveCheckpoint()
+}
+
+// Helper function to persist the checkpoint, assumes the lock is held.
+func (l *Log) saveCheckpoint() error {
+	data, err := json.Marshal(l.checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(l.dir, checkpointFile+".tmp")
+
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(l.dir, checkpointFile))
+}
+
+// Pending returns the amount of bytes which have not been committed.
+func (l *Log) Pending() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var total int64
+
+	for _, s := range l.segments {
+		if s.id == l.checkpoint.Segment {
+			total += s.size - l.checkpoint.Offset
+		} else if s.id > l.checkpoint.Segment {
+			total += s.size
+		}
+	}
+
+	return total
+}
+
+// Close the segment which is being appended to.
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active == nil {
+		return errors.New("log is already closed")
+	}
+
+	err := l.active.Close()
+	l.active = nil
+
+	return err
+}
@@ -0,0 +1,112 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to convert strings into records.
+func records(values ...string) [][]byte {
+	var r [][]byte
+
+	for _, v := range values {
+		r = append(r, []byte(v))
+	}
+
+	return r
+}
+
+// Helper function to convert records into strings.
+func values(records [][]byte) []string {
+	var v []string
+
+	for _, r := range records {
+		v = append(v, string(r))
+	}
+
+	return v
+}
+
+func TestAppendReadCommit(t *testing.T) {
+	l, err := Open(t.TempDir(), 10, 0)
+	assert.Nil(t, err)
+
+	// Each append exceeds the segment size, so each is written to its own segment.
+	assert.Nil(t, l.Append(records("one", "two")))
+	assert.Nil(t, l.Append(records("three")))
+	assert.Nil(t, l.Append(records("four")))
+
+	read, pos, err := l.Read(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, values(read))
+
+	// Reading again before committing returns the same records.
+	read, _, err = l.Read(3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, values(read))
+
+	assert.Nil(t, l.Commit(pos))
+
+	read, pos, err = l.Read(10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"four"}, values(read))
+	assert.Nil(t, l.Commit(pos))
+
+	assert.Equal(t, int64(0), l.Pending())
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, 1024, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.Append(records("one", "two", "three")))
+
+	read, pos, err := l.Read(1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"one"}, values(read))
+	assert.Nil(t, l.Commit(pos))
+	assert.Nil(t, l.Close())
+
+	// Simulate a crash part way through writing a record.
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("partial"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// Reading resumes from the checkpoint and skips the incomplete record.
+	l, err = Open(dir, 1024, 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.Append(records("four")))
+
+	read, _, err = l.Read(10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"two", "three", "four"}, values(read))
+}
+
+func TestEvict(t *testing.T) {
+	l, err := Open(t.TempDir(), 4, 10)
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.Append(records("aaaa")))
+	assert.Nil(t, l.Append(records("bbbb")))
+	assert.Nil(t, l.Append(records("cccc")))
+
+	// The oldest segment was evicted to stay within the size budget.
+	read, _, err := l.Read(10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bbbb", "cccc"}, values(read))
+}
+
+func TestAppendNewline(t *testing.T) {
+	l, err := Open(t.TempDir(), 1024, 0)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, l.Append(records("one\ntwo")))
+}